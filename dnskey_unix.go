@@ -0,0 +1,51 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package resolver
+
+import "golang.org/x/net/dns/dnsmessage"
+
+// typeDNSKEY is the DNSKEY record type, not defined in dnsmessage.
+const typeDNSKEY dnsmessage.Type = 48
+
+// DNSKEY flags, as per RFC 4034 section 2.1.1.
+const (
+	DNSKEYZoneKey uint16 = 0x0100
+	DNSKEYSEP     uint16 = 0x0001
+)
+
+// DNSKEYRecord is a DNSKEY record, as per RFC 4034. A Protocol of 0 is
+// encoded as 3, the only valid value.
+type DNSKEYRecord struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+}
+
+// pack returns the RDATA of the DNSKEY record.
+func (k *DNSKEYRecord) pack() []byte {
+	protocol := k.Protocol
+	if protocol == 0 {
+		protocol = 3
+	}
+	b := []byte{byte(k.Flags >> 8), byte(k.Flags), protocol, k.Algorithm}
+	return append(b, k.PublicKey...)
+}
+
+// WithTrustAnchor answers the DNSKEY queries for the root zone with the keys,
+// to bootstrap the validators of a self-contained DNSSEC test environment,
+// and returns the resolver.
+func (r *MemResolver) WithTrustAnchor(keys ...DNSKEYRecord) *MemResolver {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trustAnchor = append([]DNSKEYRecord{}, keys...)
+	return r
+}
+
+// rootDNSKEY returns the trust anchor keys, if any.
+func (r *MemResolver) rootDNSKEY() []DNSKEYRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.trustAnchor
+}
@@ -0,0 +1,74 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package resolver
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestWithTrustAnchor(t *testing.T) {
+	t.Parallel()
+	ksk := DNSKEYRecord{
+		Flags:     DNSKEYZoneKey | DNSKEYSEP,
+		Protocol:  3,
+		Algorithm: 8,
+		PublicKey: []byte{0x03, 0x01, 0x00, 0x01, 0xac, 0xff, 0xb4, 0x09},
+	}
+	zsk := DNSKEYRecord{
+		Flags:     DNSKEYZoneKey,
+		Protocol:  3,
+		Algorithm: 8,
+		PublicKey: []byte{0x03, 0x01, 0x00, 0x01, 0xbd, 0x12},
+	}
+	f := (&MemResolver{}).WithTrustAnchor(ksk, zsk)
+
+	msg := exchange(t, f, ".", typeDNSKEY)
+	if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 2 {
+		t.Fatalf("got %v with %d answers; want 2 answers", msg.RCode, len(msg.Answers))
+	}
+	for i, want := range []DNSKEYRecord{ksk, zsk} {
+		rr := msg.Answers[i]
+		if rr.Header.Type != typeDNSKEY || rr.Header.Name.String() != "." {
+			t.Errorf("got %v; want DNSKEY for .", rr.Header)
+		}
+		body, ok := rr.Body.(*dnsmessage.UnknownResource)
+		if !ok {
+			t.Fatalf("got %T; want *dnsmessage.UnknownResource", rr.Body)
+		}
+		got, err := unpackDNSKEY(body.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("got %+v; want %+v", *got, want)
+		}
+	}
+
+	// only the root zone has the anchor
+	if msg := exchange(t, f, "example.com.", typeDNSKEY); msg.RCode != dnsmessage.RCodeNotImplemented {
+		t.Errorf("got %v; want %v", msg.RCode, dnsmessage.RCodeNotImplemented)
+	}
+	if msg := exchange(t, &MemResolver{}, ".", typeDNSKEY); msg.RCode != dnsmessage.RCodeNotImplemented {
+		t.Errorf("got %v; want %v", msg.RCode, dnsmessage.RCodeNotImplemented)
+	}
+}
+
+var errInvalidDNSKEY = errors.New("invalid DNSKEY record")
+
+// unpackDNSKEY parses the RDATA of a DNSKEY record.
+func unpackDNSKEY(b []byte) (*DNSKEYRecord, error) {
+	if len(b) < 4 {
+		return nil, errInvalidDNSKEY
+	}
+	return &DNSKEYRecord{
+		Flags:     uint16(b[0])<<8 | uint16(b[1]),
+		Protocol:  b[2],
+		Algorithm: b[3],
+		PublicKey: append([]byte{}, b[4:]...),
+	}, nil
+}
@@ -0,0 +1,174 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package resolver
+
+import (
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// EDNS(0) option codes, ref: https://www.iana.org/assignments/dns-parameters
+const (
+	ednsOptionTCPKeepalive uint16 = 11 // RFC 7828
+	ednsOptionPadding      uint16 = 12 // RFC 7830
+)
+
+// DefaultMaxUDPSize is the EDNS(0) UDP payload size recommended by the DNS
+// flag day 2020 to avoid the IP fragmentation.
+const DefaultMaxUDPSize = 1232
+
+// DefaultViewOption is the EDNS(0) option code used to select the Views, in
+// the range reserved for local and experimental use by RFC 6891.
+const DefaultViewOption uint16 = 65001
+
+// rcodeBadVers is the extended RCODE for a not supported EDNS version.
+const rcodeBadVers dnsmessage.RCode = 16
+
+// ResponseSize configures the size of the responses.
+type ResponseSize struct {
+	// Target is the size in bytes that the responses are padded to, using
+	// the EDNS(0) Padding option. Responses bigger than Target, or to
+	// queries without EDNS(0), are not modified.
+	Target int
+}
+
+// edns contains the EDNS(0) parameters of a query, as per RFC 6891.
+type edns struct {
+	udpSize  int
+	version  uint8
+	dnssecOK bool
+	options  []dnsmessage.Option
+}
+
+// parseEDNS returns the EDNS(0) parameters of the query, the parser must be
+// positioned after the question section. It returns nil if the query does not
+// contain an OPT pseudo-record.
+func parseEDNS(p *dnsmessage.Parser) (*edns, error) {
+	if err := p.SkipAllAnswers(); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return nil, err
+	}
+	additionals, err := p.AllAdditionals()
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range additionals {
+		if rr.Header.Type != dnsmessage.TypeOPT {
+			continue
+		}
+		e := &edns{
+			udpSize:  int(rr.Header.Class),
+			version:  uint8(rr.Header.TTL >> 16),
+			dnssecOK: rr.Header.DNSSECAllowed(),
+		}
+		if opt, ok := rr.Body.(*dnsmessage.OPTResource); ok {
+			e.options = opt.Options
+		}
+		// RFC 6891: values lower than 512 MUST be treated as equal to 512
+		if e.udpSize < 512 {
+			e.udpSize = 512
+		}
+		return e, nil
+	}
+	return nil, nil
+}
+
+// view returns the resolver of the view selected by the EDNS(0) parameters.
+func (r *MemResolver) view(e *edns) *MemResolver {
+	if e == nil || len(r.Views) == 0 {
+		return r
+	}
+	code := r.ViewOption
+	if code == 0 {
+		code = DefaultViewOption
+	}
+	for _, o := range e.options {
+		if o.Code != code {
+			continue
+		}
+		if v, ok := r.Views[string(o.Data)]; ok && v != nil {
+			return v
+		}
+	}
+	return r
+}
+
+// hasOption returns true if the query contains the EDNS(0) option.
+func (e *edns) hasOption(code uint16) bool {
+	for _, o := range e.options {
+		if o.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// keepaliveOption returns the TCP Keepalive option with the timeout, capped to
+// the maximum value of the option.
+func keepaliveOption(timeout time.Duration) dnsmessage.Option {
+	units := timeout / (100 * time.Millisecond)
+	if units > 0xFFFF {
+		units = 0xFFFF
+	}
+	return dnsmessage.Option{
+		Code: ednsOptionTCPKeepalive,
+		Data: []byte{byte(units >> 8), byte(units)},
+	}
+}
+
+// optLen returns the length of an OPT pseudo-record with the options.
+func optLen(options []dnsmessage.Option) int {
+	n := 11 // root name, type, class, ttl and rdata length
+	for _, o := range options {
+		n += 4 + len(o.Data)
+	}
+	return n
+}
+
+// appendOPT appends an OPT pseudo-record to the additional section of the
+// encoded message. The upper bits of the extended RCODE are stored in the OPT
+// pseudo-record, the message header must contain the lower 4 bits. The DO bit
+// has to be copied from the query, as per RFC 3225.
+func appendOPT(msg []byte, udpSize int, extRCode dnsmessage.RCode, dnssecOK bool, options []dnsmessage.Option) []byte {
+	if len(msg) < 12 {
+		return msg
+	}
+	var h dnsmessage.ResourceHeader
+	h.SetEDNS0(udpSize, extRCode, dnssecOK)
+
+	opt := make([]byte, 11, optLen(options))
+	// opt[0] is the root name
+	binary.BigEndian.PutUint16(opt[1:], uint16(h.Type))
+	binary.BigEndian.PutUint16(opt[3:], uint16(h.Class))
+	binary.BigEndian.PutUint32(opt[5:], h.TTL)
+	binary.BigEndian.PutUint16(opt[9:], uint16(cap(opt)-11))
+	for _, o := range options {
+		opt = append(opt, byte(o.Code>>8), byte(o.Code), byte(len(o.Data)>>8), byte(len(o.Data)))
+		opt = append(opt, o.Data...)
+	}
+
+	out := make([]byte, 0, len(msg)+len(opt))
+	out = append(out, msg...)
+	arcount := binary.BigEndian.Uint16(out[10:12])
+	binary.BigEndian.PutUint16(out[10:12], arcount+1)
+	return append(out, opt...)
+}
+
+// paddingOption returns the Padding option that makes a message of length n,
+// including the OPT pseudo-record, reach the target size. It returns false if
+// the target can not be reached.
+func paddingOption(n, target int) (dnsmessage.Option, bool) {
+	padding := target - n - optLen(nil) - 4
+	if padding < 0 {
+		return dnsmessage.Option{}, false
+	}
+	return dnsmessage.Option{
+		Code: ednsOptionPadding,
+		Data: make([]byte, padding),
+	}, true
+}
@@ -0,0 +1,346 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package resolver
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newEDNSQuery returns a query message with an OPT pseudo-record advertising
+// the UDP payload size.
+func newEDNSQuery(name string, qtype dnsmessage.Type, udpSize int, options ...dnsmessage.Option) dnsmessage.Message {
+	query := newQuery(name, qtype)
+	var h dnsmessage.ResourceHeader
+	h.SetEDNS0(udpSize, dnsmessage.RCodeSuccess, false)
+	query.Additionals = []dnsmessage.Resource{{
+		Header: h,
+		Body:   &dnsmessage.OPTResource{Options: options},
+	}}
+	return query
+}
+
+// responseOPT returns the OPT pseudo-record of the response.
+func responseOPT(msg dnsmessage.Message) *dnsmessage.Resource {
+	for i := range msg.Additionals {
+		if msg.Additionals[i].Header.Type == dnsmessage.TypeOPT {
+			return &msg.Additionals[i]
+		}
+	}
+	return nil
+}
+
+func TestEDNSResponseSize(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.1"),
+	}
+	// without padding the response echoes the OPT pseudo-record
+	msg, _ := exchangeMsg(t, f, newEDNSQuery("padding.example.com.", dnsmessage.TypeA, 1232), true)
+	if opt := responseOPT(msg); opt == nil || opt.Header.Class != 1232 {
+		t.Fatalf("got OPT %v; want OPT with UDP size 1232", opt)
+	}
+	if len(msg.Answers) != 1 {
+		t.Fatalf("got %d answers; want 1", len(msg.Answers))
+	}
+
+	var responseSizeTests = []struct {
+		target  int
+		udpSize int
+		want    int
+	}{
+		{1232, 1232, 1232},
+		{1452, 1452, 1452},
+		{4096, 4096, 4096},
+		{4096, 1232, 1232},
+	}
+	for _, tt := range responseSizeTests {
+		f := &MemResolver{
+			LookupIP:     f.LookupIP,
+			ResponseSize: ResponseSize{Target: tt.target},
+			// the targets bigger than DefaultMaxUDPSize
+			MaxUDPSize: -1,
+		}
+		msg, n := exchangeMsg(t, f, newEDNSQuery("padding.example.com.", dnsmessage.TypeA, tt.udpSize), true)
+		if n != tt.want {
+			t.Errorf("target %d udp size %d: got %d bytes; want %d", tt.target, tt.udpSize, n, tt.want)
+		}
+		if len(msg.Answers) != 1 || msg.Truncated {
+			t.Errorf("target %d udp size %d: got %d answers truncated %v; want 1 answer", tt.target, tt.udpSize, len(msg.Answers), msg.Truncated)
+		}
+	}
+
+	// queries without EDNS(0) are not padded
+	f.ResponseSize.Target = 1232
+	if _, n := exchangeMsg(t, f, newQuery("padding.example.com.", dnsmessage.TypeA), true); n >= 512 {
+		t.Errorf("got %d bytes; want a response without padding", n)
+	}
+}
+
+func TestEDNSBadVersion(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			t.Errorf("unexpected lookup for %s", host)
+			return nil, nil
+		},
+	}
+	query := newEDNSQuery("version.example.com.", dnsmessage.TypeA, 1232)
+	// EDNS version 1
+	query.Additionals[0].Header.TTL |= 1 << 16
+	msg, _ := exchangeMsg(t, f, query, true)
+	opt := responseOPT(msg)
+	if opt == nil {
+		t.Fatal("got response without OPT")
+	}
+	if rcode := opt.Header.ExtendedRCode(msg.RCode); rcode != rcodeBadVers {
+		t.Errorf("got rcode %v; want BADVERS", rcode)
+	}
+	if version := uint8(opt.Header.TTL >> 16); version != 0 {
+		t.Errorf("got EDNS version %d; want 0", version)
+	}
+	if len(msg.Answers) != 0 {
+		t.Errorf("got %d answers; want 0", len(msg.Answers))
+	}
+}
+
+func TestDisableEDNS(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			return manyIPs(100), nil
+		},
+		DisableEDNS: true,
+	}
+	msg, n := exchangeMsg(t, f, newEDNSQuery("noedns.example.com.", dnsmessage.TypeA, 4096), true)
+	if opt := responseOPT(msg); opt != nil {
+		t.Errorf("got OPT %v; want no OPT", opt)
+	}
+	if !msg.Truncated || n > 512 {
+		t.Errorf("got %d bytes truncated %v; want truncated response up to 512 bytes", n, msg.Truncated)
+	}
+
+	// the EDNS version is not checked
+	query := newEDNSQuery("noedns.example.com.", dnsmessage.TypeA, 4096)
+	query.Additionals[0].Header.TTL |= 1 << 16
+	msg, _ = exchangeMsg(t, f, query, true)
+	if !msg.Truncated || responseOPT(msg) != nil {
+		t.Errorf("got OPT %v truncated %v; want truncated response without OPT", responseOPT(msg), msg.Truncated)
+	}
+
+	// the same query succeeds with EDNS(0), without the UDP size cap
+	f.DisableEDNS = false
+	f.MaxUDPSize = -1
+	msg, _ = exchangeMsg(t, f, newEDNSQuery("noedns.example.com.", dnsmessage.TypeA, 4096), true)
+	if msg.Truncated || len(msg.Answers) != 100 || responseOPT(msg) == nil {
+		t.Errorf("got %d answers truncated %v; want 100 answers with OPT", len(msg.Answers), msg.Truncated)
+	}
+}
+
+func TestViews(t *testing.T) {
+	t.Parallel()
+	f := resolverWithIP("192.0.2.1")
+	f.Views = map[string]*MemResolver{
+		"internal": resolverWithIP("10.0.0.1"),
+		"external": resolverWithIP("198.51.100.1"),
+	}
+	var viewTests = []struct {
+		code uint16
+		view string
+		want string
+	}{
+		{DefaultViewOption, "internal", "10.0.0.1"},
+		{DefaultViewOption, "external", "198.51.100.1"},
+		{DefaultViewOption, "unknown", "192.0.2.1"},
+		{65002, "internal", "192.0.2.1"},
+	}
+	for _, tt := range viewTests {
+		query := newEDNSQuery("www.example.com.", dnsmessage.TypeA, 1232, dnsmessage.Option{Code: tt.code, Data: []byte(tt.view)})
+		msg, _ := exchangeMsg(t, f, query, true)
+		if len(msg.Answers) != 1 {
+			t.Fatalf("%s: got %d answers; want 1", tt.view, len(msg.Answers))
+		}
+		if got := net.IP(msg.Answers[0].Body.(*dnsmessage.AResource).A[:]); !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("%d %s: got %v; want %s", tt.code, tt.view, got, tt.want)
+		}
+	}
+	// queries without EDNS(0) use the base view
+	msg := exchange(t, f, "www.example.com.", dnsmessage.TypeA)
+	if got := net.IP(msg.Answers[0].Body.(*dnsmessage.AResource).A[:]); !got.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("got %v; want 192.0.2.1", got)
+	}
+	// the option code can be configured
+	f.ViewOption = 65002
+	query := newEDNSQuery("www.example.com.", dnsmessage.TypeA, 1232, dnsmessage.Option{Code: 65002, Data: []byte("internal")})
+	msg, _ = exchangeMsg(t, f, query, true)
+	if got := net.IP(msg.Answers[0].Body.(*dnsmessage.AResource).A[:]); !got.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("got %v; want 10.0.0.1", got)
+	}
+}
+
+func TestMaxUDPSize(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			// 100 A records are around 1650 bytes
+			return manyIPs(100), nil
+		},
+	}
+	// the cap is DefaultMaxUDPSize by default
+	query := newEDNSQuery("large.example.com.", dnsmessage.TypeA, 65535)
+	msg, n := exchangeMsg(t, f, query, true)
+	if !msg.Truncated || n > DefaultMaxUDPSize {
+		t.Errorf("got %d bytes truncated %v; want truncated response up to %d bytes", n, msg.Truncated, DefaultMaxUDPSize)
+	}
+	if opt := responseOPT(msg); opt == nil || int(opt.Header.Class) != DefaultMaxUDPSize {
+		t.Errorf("got OPT %v; want UDP size %d", opt, DefaultMaxUDPSize)
+	}
+	// TCP is not limited
+	msg, _ = exchangeMsg(t, f, query, false)
+	if msg.Truncated || len(msg.Answers) != 100 {
+		t.Errorf("got %d answers truncated %v; want 100 answers", len(msg.Answers), msg.Truncated)
+	}
+	// a custom cap
+	f.MaxUDPSize = 1400
+	msg, n = exchangeMsg(t, f, query, true)
+	if !msg.Truncated || n > 1400 {
+		t.Errorf("got %d bytes truncated %v; want truncated response up to 1400 bytes", n, msg.Truncated)
+	}
+	if opt := responseOPT(msg); opt == nil || opt.Header.Class != 1400 {
+		t.Errorf("got OPT %v; want UDP size 1400", opt)
+	}
+	// without the cap the advertised size is used
+	f.MaxUDPSize = -1
+	msg, n = exchangeMsg(t, f, query, true)
+	if msg.Truncated || len(msg.Answers) != 100 || n <= DefaultMaxUDPSize {
+		t.Errorf("got %d bytes truncated %v; want the full response", n, msg.Truncated)
+	}
+}
+
+func TestTCPKeepalive(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP:     lookupIPs("192.0.2.1"),
+		TCPKeepalive: 30 * time.Second,
+	}
+	keepalive := dnsmessage.Option{Code: ednsOptionTCPKeepalive}
+	query := newEDNSQuery("keepalive.example.com.", dnsmessage.TypeA, 1232, keepalive)
+
+	msg, _ := exchangeMsg(t, f, query, false)
+	opt := responseOPT(msg)
+	if opt == nil {
+		t.Fatal("expected OPT in the response")
+	}
+	options := opt.Body.(*dnsmessage.OPTResource).Options
+	if len(options) != 1 || options[0].Code != ednsOptionTCPKeepalive {
+		t.Fatalf("got options %v; want TCP Keepalive", options)
+	}
+	// 30 seconds are 300 units of 100 milliseconds
+	if data := options[0].Data; len(data) != 2 || int(data[0])<<8|int(data[1]) != 300 {
+		t.Errorf("got timeout %v; want 300", data)
+	}
+
+	// the option is never sent over UDP
+	msg, _ = exchangeMsg(t, f, query, true)
+	if opt := responseOPT(msg); opt == nil || len(opt.Body.(*dnsmessage.OPTResource).Options) != 0 {
+		t.Errorf("got OPT %v; want OPT without options", opt)
+	}
+	// nor to the queries without the option
+	msg, _ = exchangeMsg(t, f, newEDNSQuery("keepalive.example.com.", dnsmessage.TypeA, 1232), false)
+	if opt := responseOPT(msg); opt == nil || len(opt.Body.(*dnsmessage.OPTResource).Options) != 0 {
+		t.Errorf("got OPT %v; want OPT without options", opt)
+	}
+
+	// the padding accounts for the keepalive option
+	f.ResponseSize = ResponseSize{Target: 468}
+	msg, n := exchangeMsg(t, f, query, false)
+	if n != 468 {
+		t.Errorf("got %d bytes; want 468", n)
+	}
+	if options := responseOPT(msg).Body.(*dnsmessage.OPTResource).Options; len(options) != 2 || options[1].Code != ednsOptionPadding {
+		t.Errorf("got options %v; want TCP Keepalive and Padding", options)
+	}
+}
+
+func TestCheckingDisabled(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}, nil
+		},
+	}
+	query := newEDNSQuery("cd.example.com.", dnsmessage.TypeA, 1232)
+	query.Additionals[0].Header.SetEDNS0(1232, dnsmessage.RCodeSuccess, true)
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answers [2][]dnsmessage.Resource
+	for i, cd := range []bool{false, true} {
+		q := append([]byte{}, b...)
+		if cd {
+			q[3] |= 0x10
+		}
+		resp := f.dnsPacketRoundTrip(q)
+		if got := resp[3]&0x10 != 0; got != cd {
+			t.Errorf("CD %v: got CD %v in the response", cd, got)
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(resp); err != nil {
+			t.Fatal(err)
+		}
+		if msg.RCode != dnsmessage.RCodeSuccess {
+			t.Errorf("CD %v: got %v; want %v", cd, msg.RCode, dnsmessage.RCodeSuccess)
+		}
+		answers[i] = msg.Answers
+	}
+	if len(answers[0]) != 2 || !reflect.DeepEqual(answers[0], answers[1]) {
+		t.Errorf("got answers %v with CD=0 and %v with CD=1; want the same records", answers[0], answers[1])
+	}
+
+	// the error responses echo it too
+	q := append([]byte{}, b...)
+	q[2] |= 0x78 // OPCODE 15
+	q[3] |= 0x10
+	if resp := f.dnsPacketRoundTrip(q); resp[3]&0x10 == 0 {
+		t.Errorf("got CD unset in the error response")
+	}
+}
+
+func TestDNSSECOKTruncated(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			return manyIPs(100), nil
+		},
+	}
+	for _, do := range []bool{false, true} {
+		query := newEDNSQuery("dnssec.example.com.", dnsmessage.TypeA, 1232)
+		query.Additionals[0].Header.SetEDNS0(1232, dnsmessage.RCodeSuccess, do)
+
+		// truncated response
+		msg, n := exchangeMsg(t, f, query, true)
+		if !msg.Truncated || n > 1232 {
+			t.Errorf("DO %v: got %d bytes truncated %v; want truncated response", do, n, msg.Truncated)
+		}
+		opt := responseOPT(msg)
+		if opt == nil {
+			t.Fatalf("DO %v: expected OPT in the truncated response", do)
+		}
+		if opt.Header.DNSSECAllowed() != do || opt.Header.Class != 1232 {
+			t.Errorf("DO %v: got OPT with DO %v and size %d", do, opt.Header.DNSSECAllowed(), opt.Header.Class)
+		}
+
+		// full response over TCP
+		msg, _ = exchangeMsg(t, f, query, false)
+		if opt := responseOPT(msg); opt == nil || opt.Header.DNSSECAllowed() != do {
+			t.Errorf("DO %v: got OPT %v; want the DO bit echoed", do, opt)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package resolver
+
+import (
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// typeNSEC3 is the NSEC3 record type, not defined in dnsmessage.
+const typeNSEC3 dnsmessage.Type = 50
+
+// NSEC3OptOut is the Opt-Out flag of the NSEC3 records, as per RFC 5155
+// section 3.1.2.
+const NSEC3OptOut uint8 = 1
+
+// base32Hex is the base32 encoding with the extended hex alphabet, without
+// padding, used by the NSEC3 hashed owner names.
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+var errInvalidNSEC3 = errors.New("invalid NSEC3 record")
+
+// NSEC3 is a NSEC3 record, as per RFC 5155.
+type NSEC3 struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	// NextHashedOwner is the binary hash of the next owner name in the
+	// hash order, see NSEC3Hash for the base32hex label.
+	NextHashedOwner []byte
+	// Types are the types present at the original owner name.
+	Types []dnsmessage.Type
+}
+
+// NSEC3Hash returns the base32hex encoded SHA-1 hash of name with the salt
+// and the number of additional iterations, that is the first label of the
+// NSEC3 owner name, as per RFC 5155 section 5.
+func NSEC3Hash(name string, salt []byte, iterations uint16) (string, error) {
+	n, err := dnsmessage.NewName(canonicalName(name))
+	if err != nil {
+		return "", err
+	}
+	// the wire format of the name, there is no compression for a single name
+	wire, err := (&dnsmessage.Message{
+		Questions: []dnsmessage.Question{{Name: n, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return "", err
+	}
+	wire = wire[12 : len(wire)-4]
+	h := sha1.Sum(append(wire, salt...))
+	for i := 0; i < int(iterations); i++ {
+		h = sha1.Sum(append(h[:], salt...))
+	}
+	return strings.ToLower(base32Hex.EncodeToString(h[:])), nil
+}
+
+// pack returns the RDATA of the NSEC3 record.
+func (n *NSEC3) pack() ([]byte, error) {
+	if len(n.Salt) > 255 || len(n.NextHashedOwner) == 0 || len(n.NextHashedOwner) > 255 {
+		return nil, errInvalidNSEC3
+	}
+	b := []byte{n.HashAlgorithm, n.Flags, byte(n.Iterations >> 8), byte(n.Iterations)}
+	b = append(b, byte(len(n.Salt)))
+	b = append(b, n.Salt...)
+	b = append(b, byte(len(n.NextHashedOwner)))
+	b = append(b, n.NextHashedOwner...)
+	return append(b, typeBitmap(n.Types)...), nil
+}
+
+// typeBitmap returns the type bit maps field of the types, as per RFC 4034
+// section 4.1.2.
+func typeBitmap(types []dnsmessage.Type) []byte {
+	sorted := append([]dnsmessage.Type{}, types...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var b []byte
+	for i := 0; i < len(sorted); {
+		window := byte(sorted[i] >> 8)
+		var bitmap [32]byte
+		length := 0
+		for ; i < len(sorted) && byte(sorted[i]>>8) == window; i++ {
+			low := byte(sorted[i])
+			bitmap[low/8] |= 0x80 >> (low % 8)
+			length = int(low/8) + 1
+		}
+		b = append(b, window, byte(length))
+		b = append(b, bitmap[:length]...)
+	}
+	return b
+}
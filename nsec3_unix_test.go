@@ -0,0 +1,139 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNSEC3Hash(t *testing.T) {
+	t.Parallel()
+	// RFC 5155 Appendix A
+	salt := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+	var hashTests = []struct {
+		name string
+		hash string
+	}{
+		{"example", "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom"},
+		{"a.example", "35mthgpgcu1qg68fab165klnsnk3dpvl"},
+		{"ns1.example.", "2t7b4g4vsa5smi47k61mv5bv1a22bojr"},
+	}
+	for _, tt := range hashTests {
+		got, err := NSEC3Hash(tt.name, salt, 12)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.hash {
+			t.Errorf("%s: got %s; want %s", tt.name, got, tt.hash)
+		}
+	}
+}
+
+func TestLookupNSEC3(t *testing.T) {
+	t.Parallel()
+	next, err := base32Hex.DecodeString("2T7B4G4VSA5SMI47K61MV5BV1A22BOJR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &NSEC3{
+		HashAlgorithm:   1,
+		Flags:           NSEC3OptOut,
+		Iterations:      12,
+		Salt:            []byte{0xaa, 0xbb, 0xcc, 0xdd},
+		NextHashedOwner: next,
+		Types:           []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeNS, dnsmessage.TypeSOA, dnsmessage.TypeMX, dnsmessage.TypeAAAA, 46, 48, 51, 1234},
+	}
+	f := &MemResolver{
+		LookupNSEC3: func(ctx context.Context, name string) ([]*NSEC3, error) {
+			return []*NSEC3{want}, nil
+		},
+	}
+	msg := exchange(t, f, "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example.", typeNSEC3)
+	if len(msg.Answers) != 1 {
+		t.Fatalf("got %d answers; want 1", len(msg.Answers))
+	}
+	if msg.Answers[0].Header.Type != typeNSEC3 {
+		t.Errorf("got type %v; want NSEC3", msg.Answers[0].Header.Type)
+	}
+	body, ok := msg.Answers[0].Body.(*dnsmessage.UnknownResource)
+	if !ok {
+		t.Fatalf("got %T; want *dnsmessage.UnknownResource", msg.Answers[0].Body)
+	}
+	got, err := unpackNSEC3(body.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+	if !bytes.Equal(got.NextHashedOwner, next) {
+		t.Errorf("got next hashed owner %x; want %x", got.NextHashedOwner, next)
+	}
+
+	// without LookupNSEC3 the queries are not implemented
+	msg = exchange(t, &MemResolver{}, "example.", typeNSEC3)
+	if msg.RCode != dnsmessage.RCodeNotImplemented {
+		t.Errorf("got %v; want %v", msg.RCode, dnsmessage.RCodeNotImplemented)
+	}
+}
+
+// unpackNSEC3 parses the RDATA of a NSEC3 record.
+func unpackNSEC3(b []byte) (*NSEC3, error) {
+	if len(b) < 5 {
+		return nil, errInvalidNSEC3
+	}
+	n := &NSEC3{
+		HashAlgorithm: b[0],
+		Flags:         b[1],
+		Iterations:    uint16(b[2])<<8 | uint16(b[3]),
+	}
+	saltLen := int(b[4])
+	b = b[5:]
+	if len(b) < saltLen+1 {
+		return nil, errInvalidNSEC3
+	}
+	n.Salt = append([]byte{}, b[:saltLen]...)
+	b = b[saltLen:]
+	hashLen := int(b[0])
+	b = b[1:]
+	if hashLen == 0 || len(b) < hashLen {
+		return nil, errInvalidNSEC3
+	}
+	n.NextHashedOwner = append([]byte{}, b[:hashLen]...)
+	types, err := parseTypeBitmap(b[hashLen:])
+	if err != nil {
+		return nil, err
+	}
+	n.Types = types
+	return n, nil
+}
+
+// parseTypeBitmap returns the types of a type bit maps field.
+func parseTypeBitmap(b []byte) ([]dnsmessage.Type, error) {
+	var types []dnsmessage.Type
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, errInvalidNSEC3
+		}
+		window, length := b[0], int(b[1])
+		b = b[2:]
+		if length == 0 || length > 32 || len(b) < length {
+			return nil, errInvalidNSEC3
+		}
+		for i, octet := range b[:length] {
+			for bit := 0; bit < 8; bit++ {
+				if octet&(0x80>>bit) != 0 {
+					types = append(types, dnsmessage.Type(uint16(window)<<8|uint16(i*8+bit)))
+				}
+			}
+		}
+		b = b[length:]
+	}
+	return types, nil
+}
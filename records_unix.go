@@ -0,0 +1,423 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// NewFromMap returns a MemResolver that answers the records of the map, indexed
+// by name and record type. The record values use the zone file RDATA text
+// format, per example "10 mail.example.com." for MX records or
+// "10 5 443 www.example.com." for SRV records (priority, weight, port and
+// target). Supported types are A, AAAA, NS, CNAME, MX, TXT, SRV and PTR. The
+// TXT values are sequences of quoted character strings, per example
+// "v=spf1 -all" "second string", with the \" and \\ escapes, or a single
+// string without quotes, each string up to 255 bytes. The strings of all the
+// TXT values of a name are answered in a single TXT record.
+//
+// The names without records of the queried type return ErrNoData, that is an
+// empty answer, and the names not present in the map return a not found error.
+func NewFromMap(records map[string]map[dnsmessage.Type][]string) (*MemResolver, error) {
+	z := zone{}
+	for name, types := range records {
+		name = canonicalName(name)
+		if _, ok := z[name]; !ok {
+			z[name] = &zoneNode{}
+		}
+		for t, values := range types {
+			for _, v := range values {
+				if err := z[name].add(t, v); err != nil {
+					return nil, fmt.Errorf("invalid %v record %q for %s: %w", t, v, name, err)
+				}
+			}
+		}
+	}
+	return z.resolver(), nil
+}
+
+// zoneNode contains the records of a name.
+type zoneNode struct {
+	ipv4  []net.IP
+	ipv6  []net.IP
+	ns    []*net.NS
+	cname string
+	mx    []*net.MX
+	txt   []string
+	srv   []*net.SRV
+	ptr   []string
+}
+
+// add parses the RDATA text of a record of type t and adds it to the node.
+func (n *zoneNode) add(t dnsmessage.Type, rdata string) error {
+	fields := strings.Fields(rdata)
+	switch t {
+	case dnsmessage.TypeA:
+		ip := net.ParseIP(rdata)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("not an IPv4 address")
+		}
+		n.ipv4 = append(n.ipv4, ip)
+	case dnsmessage.TypeAAAA:
+		ip := net.ParseIP(rdata)
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("not an IPv6 address")
+		}
+		n.ipv6 = append(n.ipv6, ip)
+	case dnsmessage.TypeNS:
+		host, err := parseHost(fields)
+		if err != nil {
+			return err
+		}
+		n.ns = append(n.ns, &net.NS{Host: host})
+	case dnsmessage.TypeCNAME:
+		if n.cname != "" {
+			return fmt.Errorf("only one CNAME is allowed")
+		}
+		host, err := parseHost(fields)
+		if err != nil {
+			return err
+		}
+		n.cname = host
+	case dnsmessage.TypeMX:
+		if len(fields) != 2 {
+			return fmt.Errorf("expected preference and host")
+		}
+		pref, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return err
+		}
+		host, err := parseHost(fields[1:])
+		if err != nil {
+			return err
+		}
+		n.mx = append(n.mx, &net.MX{Host: host, Pref: uint16(pref)})
+	case dnsmessage.TypeTXT:
+		txt, err := parseTXT(rdata)
+		if err != nil {
+			return err
+		}
+		n.txt = append(n.txt, txt...)
+	case dnsmessage.TypeSRV:
+		if len(fields) != 4 {
+			return fmt.Errorf("expected priority, weight, port and target")
+		}
+		var values [3]uint16
+		for i := range values {
+			v, err := strconv.ParseUint(fields[i], 10, 16)
+			if err != nil {
+				return err
+			}
+			values[i] = uint16(v)
+		}
+		target, err := parseHost(fields[3:])
+		if err != nil {
+			return err
+		}
+		n.srv = append(n.srv, &net.SRV{Priority: values[0], Weight: values[1], Port: values[2], Target: target})
+	case dnsmessage.TypePTR:
+		host, err := parseHost(fields)
+		if err != nil {
+			return err
+		}
+		n.ptr = append(n.ptr, host)
+	default:
+		return fmt.Errorf("record type not supported")
+	}
+	return nil
+}
+
+// parseHost returns the fully qualified host name of a single field RDATA.
+func parseHost(fields []string) (string, error) {
+	if len(fields) != 1 {
+		return "", fmt.Errorf("expected a host name")
+	}
+	host := canonicalName(fields[0])
+	if _, err := dnsmessage.NewName(host); err != nil {
+		return "", err
+	}
+	return host, nil
+}
+
+// zone contains the nodes indexed by canonical name.
+type zone map[string]*zoneNode
+
+// lookup returns the node for name or a not found error.
+func (z zone) lookup(name string) (*zoneNode, error) {
+	n, ok := z[canonicalName(name)]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return n, nil
+}
+
+// resolver returns a MemResolver with Lookup functions answering from the zone.
+func (z zone) resolver() *MemResolver {
+	return &MemResolver{
+		LookupAddr: func(ctx context.Context, addr string) ([]string, error) {
+			name := addr
+			if ip := net.ParseIP(addr); ip != nil {
+				name = reverseName(ip)
+			}
+			n, err := z.lookup(name)
+			if err != nil {
+				return nil, err
+			}
+			if len(n.ptr) == 0 {
+				return nil, ErrNoData
+			}
+			return n.ptr, nil
+		},
+		LookupCNAME: func(ctx context.Context, host string) (string, error) {
+			n, err := z.lookup(host)
+			if err != nil {
+				return "", err
+			}
+			if n.cname == "" {
+				return "", ErrNoData
+			}
+			return n.cname, nil
+		},
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			n, err := z.lookup(host)
+			if err != nil {
+				return nil, err
+			}
+			var ips []net.IP
+			switch network {
+			case "ip4":
+				ips = n.ipv4
+			case "ip6":
+				ips = n.ipv6
+			default:
+				ips = append(append([]net.IP{}, n.ipv4...), n.ipv6...)
+			}
+			if len(ips) == 0 {
+				return nil, ErrNoData
+			}
+			return ips, nil
+		},
+		LookupMX: func(ctx context.Context, name string) ([]*net.MX, error) {
+			n, err := z.lookup(name)
+			if err != nil {
+				return nil, err
+			}
+			if len(n.mx) == 0 {
+				return nil, ErrNoData
+			}
+			return n.mx, nil
+		},
+		LookupNS: func(ctx context.Context, name string) ([]*net.NS, error) {
+			n, err := z.lookup(name)
+			if err != nil {
+				return nil, err
+			}
+			if len(n.ns) == 0 {
+				return nil, ErrNoData
+			}
+			return n.ns, nil
+		},
+		LookupSRV: func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+			n, err := z.lookup(name)
+			if err != nil {
+				return "", nil, err
+			}
+			if len(n.srv) == 0 {
+				return "", nil, ErrNoData
+			}
+			return canonicalName(name), n.srv, nil
+		},
+		LookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			n, err := z.lookup(name)
+			if err != nil {
+				return nil, err
+			}
+			if len(n.txt) == 0 {
+				return nil, ErrNoData
+			}
+			return n.txt, nil
+		},
+	}
+}
+
+// Record is a resource record in the text format of ParseRecords.
+type Record struct {
+	Name string
+	TTL  uint32
+	Type dnsmessage.Type
+	// Data is the RDATA in the zone file text format, see NewFromMap. Each
+	// TXT Record is answered as a separate TXT record.
+	Data string
+}
+
+// recordTypes are the record types supported by ParseRecords, by name.
+var recordTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"NS":    dnsmessage.TypeNS,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"TXT":   dnsmessage.TypeTXT,
+	"SRV":   dnsmessage.TypeSRV,
+	"PTR":   dnsmessage.TypePTR,
+}
+
+// ParseRecords parses one record per line with the format "name TTL TYPE
+// rdata", per example "www.example.com. 300 A 192.0.2.1". The rdata is the
+// rest of the line, in the format of NewFromMap. The empty lines and the
+// lines starting with ';' are ignored.
+func ParseRecords(s string) ([]Record, error) {
+	var records []Record
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %d: expected name, TTL, type and data", i+1)
+		}
+		ttl, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid TTL %q: %w", i+1, fields[1], err)
+		}
+		t, ok := recordTypes[strings.ToUpper(fields[2])]
+		if !ok {
+			return nil, fmt.Errorf("line %d: record type %q not supported", i+1, fields[2])
+		}
+		// the data is the rest of the line, to keep the spaces of the TXT
+		data := line
+		for _, f := range fields[:3] {
+			data = strings.TrimSpace(strings.TrimPrefix(data, f))
+		}
+		records = append(records, Record{Name: fields[0], TTL: uint32(ttl), Type: t, Data: data})
+	}
+	return records, nil
+}
+
+// NewFromRecords returns a MemResolver that answers the records, with their
+// TTLs. As with NewFromMap, the names without records of the queried type
+// have an empty answer, and the names not present return a not found error.
+// The RRsets are answered as the ones of the Lookup functions, as per
+// DedupPolicy, MaxRecordsPerRRset, ShuffleAnswers and SingleAnswer.
+func NewFromRecords(records []Record) (*MemResolver, error) {
+	rrsets := map[string][]dnsmessage.Resource{}
+	cnames := map[string]bool{}
+	for _, rec := range records {
+		name := canonicalName(rec.Name)
+		n, err := dnsmessage.NewName(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name %q: %w", rec.Name, err)
+		}
+		if rec.Type == dnsmessage.TypeCNAME {
+			if cnames[name] {
+				return nil, fmt.Errorf("invalid %v record %q for %s: only one CNAME is allowed", rec.Type, rec.Data, name)
+			}
+			cnames[name] = true
+		}
+		node := &zoneNode{}
+		if err := node.add(rec.Type, rec.Data); err != nil {
+			return nil, fmt.Errorf("invalid %v record %q for %s: %w", rec.Type, rec.Data, name, err)
+		}
+		body, err := node.resourceBody(rec.Type)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v record %q for %s: %w", rec.Type, rec.Data, name, err)
+		}
+		rrsets[name] = append(rrsets[name], dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: n, Type: rec.Type, Class: dnsmessage.ClassINET, TTL: rec.TTL},
+			Body:   body,
+		})
+	}
+	return &MemResolver{
+		Lookup: func(ctx context.Context, q dnsmessage.Question) ([]dnsmessage.Resource, dnsmessage.RCode, error) {
+			name := q.Name.String()
+			rrset, ok := rrsets[canonicalName(name)]
+			if !ok {
+				return nil, dnsmessage.RCodeSuccess, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+			}
+			var answers []dnsmessage.Resource
+			for _, rr := range rrset {
+				if rr.Header.Type != q.Type {
+					continue
+				}
+				// the answers preserve the case of the question
+				rr.Header.Name = q.Name
+				rr.Header.Class = q.Class
+				answers = append(answers, rr)
+			}
+			return answers, dnsmessage.RCodeSuccess, nil
+		},
+	}, nil
+}
+
+// parseTXT returns the character strings of the TXT rdata in the zone file
+// format, the quoted strings are split and unescaped. The rdata without quotes
+// is a single string. The strings can not be longer than 255 bytes.
+func parseTXT(rdata string) ([]string, error) {
+	rdata = strings.TrimSpace(rdata)
+	if !strings.HasPrefix(rdata, `"`) {
+		if len(rdata) > 255 {
+			return nil, fmt.Errorf("string longer than 255 bytes")
+		}
+		return []string{rdata}, nil
+	}
+	var txt []string
+	for ; rdata != ""; rdata = strings.TrimSpace(rdata) {
+		if rdata[0] != '"' {
+			return nil, fmt.Errorf("expected a quoted string")
+		}
+		var sb strings.Builder
+		i := 1
+		for ; i < len(rdata) && rdata[i] != '"'; i++ {
+			if rdata[i] == '\\' && i+1 < len(rdata) {
+				i++
+			}
+			sb.WriteByte(rdata[i])
+		}
+		if i == len(rdata) {
+			return nil, fmt.Errorf("unterminated quoted string")
+		}
+		if sb.Len() > 255 {
+			return nil, fmt.Errorf("string longer than 255 bytes")
+		}
+		txt = append(txt, sb.String())
+		rdata = rdata[i+1:]
+	}
+	return txt, nil
+}
+
+// resourceBody returns the resource body of the first record of type t of a
+// node.
+func (n *zoneNode) resourceBody(t dnsmessage.Type) (dnsmessage.ResourceBody, error) {
+	switch {
+	case t == dnsmessage.TypeA && len(n.ipv4) > 0:
+		var a [4]byte
+		copy(a[:], n.ipv4[0].To4())
+		return &dnsmessage.AResource{A: a}, nil
+	case t == dnsmessage.TypeAAAA && len(n.ipv6) > 0:
+		var aaaa [16]byte
+		copy(aaaa[:], n.ipv6[0].To16())
+		return &dnsmessage.AAAAResource{AAAA: aaaa}, nil
+	case t == dnsmessage.TypeNS && len(n.ns) > 0:
+		return &dnsmessage.NSResource{NS: dnsmessage.MustNewName(n.ns[0].Host)}, nil
+	case t == dnsmessage.TypeCNAME && n.cname != "":
+		return &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(n.cname)}, nil
+	case t == dnsmessage.TypeMX && len(n.mx) > 0:
+		return &dnsmessage.MXResource{Pref: n.mx[0].Pref, MX: dnsmessage.MustNewName(n.mx[0].Host)}, nil
+	case t == dnsmessage.TypeTXT && len(n.txt) > 0:
+		return &dnsmessage.TXTResource{TXT: n.txt}, nil
+	case t == dnsmessage.TypeSRV && len(n.srv) > 0:
+		srv := n.srv[0]
+		return &dnsmessage.SRVResource{Priority: srv.Priority, Weight: srv.Weight, Port: srv.Port, Target: dnsmessage.MustNewName(srv.Target)}, nil
+	case t == dnsmessage.TypePTR && len(n.ptr) > 0:
+		return &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(n.ptr[0])}, nil
+	}
+	return nil, fmt.Errorf("record type not supported")
+}
@@ -0,0 +1,285 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package resolver
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNewFromMap(t *testing.T) {
+	t.Parallel()
+	f, err := NewFromMap(map[string]map[dnsmessage.Type][]string{
+		"example.com": {
+			dnsmessage.TypeA:    {"192.0.2.1", "192.0.2.2"},
+			dnsmessage.TypeAAAA: {"2001:db8::1"},
+			dnsmessage.TypeNS:   {"ns1.example.com.", "ns2.example.com"},
+			dnsmessage.TypeMX:   {"10 mail.example.com."},
+			dnsmessage.TypeTXT:  {"v=spf1 -all"},
+		},
+		"_sip._udp.example.com.": {
+			dnsmessage.TypeSRV: {"10 5 5060 sip.example.com."},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewMemoryResolver(f)
+	ctx := context.Background()
+
+	ips, err := r.LookupIP(ctx, "ip4", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || ips[0].String() != "192.0.2.1" || ips[1].String() != "192.0.2.2" {
+		t.Errorf("got %v; want [192.0.2.1 192.0.2.2]", ips)
+	}
+	ips, err = r.LookupIP(ctx, "ip6", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || ips[0].String() != "2001:db8::1" {
+		t.Errorf("got %v; want [2001:db8::1]", ips)
+	}
+	nss, err := r.LookupNS(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nss) != 2 || nss[0].Host != "ns1.example.com." || nss[1].Host != "ns2.example.com." {
+		t.Errorf("got %v; want ns1.example.com. and ns2.example.com.", nss)
+	}
+	mxs, err := r.LookupMX(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mxs) != 1 || mxs[0].Host != "mail.example.com." || mxs[0].Pref != 10 {
+		t.Errorf("got %v; want 10 mail.example.com.", mxs)
+	}
+	txts, err := r.LookupTXT(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txts) != 1 || txts[0] != "v=spf1 -all" {
+		t.Errorf("got %q; want [\"v=spf1 -all\"]", txts)
+	}
+	_, srvs, err := r.LookupSRV(ctx, "sip", "udp", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srvs) != 1 || srvs[0].Target != "sip.example.com." || srvs[0].Port != 5060 || srvs[0].Priority != 10 || srvs[0].Weight != 5 {
+		t.Errorf("got %v; want 10 5 5060 sip.example.com.", srvs)
+	}
+	// the name exists but has no TXT records
+	msg := exchange(t, f, "_sip._udp.example.com.", dnsmessage.TypeTXT)
+	if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 0 {
+		t.Errorf("got %v with %d answers; want an empty answer", msg.RCode, len(msg.Answers))
+	}
+}
+
+func TestNewFromMapInvalid(t *testing.T) {
+	t.Parallel()
+	var invalidTests = []map[dnsmessage.Type][]string{
+		{dnsmessage.TypeA: {"2001:db8::1"}},
+		{dnsmessage.TypeAAAA: {"192.0.2.1"}},
+		{dnsmessage.TypeMX: {"mail.example.com."}},
+		{dnsmessage.TypeSRV: {"10 5 sip.example.com."}},
+		{dnsmessage.TypeCNAME: {"a.example.com.", "b.example.com."}},
+		{dnsmessage.TypeHINFO: {"cpu os"}},
+		{dnsmessage.TypeTXT: {strings.Repeat("a", 256)}},
+		{dnsmessage.TypeTXT: {`"` + strings.Repeat("a", 256) + `"`}},
+	}
+	for _, tt := range invalidTests {
+		if _, err := NewFromMap(map[string]map[dnsmessage.Type][]string{"example.com.": tt}); err == nil {
+			t.Errorf("%v: expected error", tt)
+		}
+	}
+}
+
+func TestParseRecords(t *testing.T) {
+	t.Parallel()
+	records, err := ParseRecords(`
+; fixture
+example.com.          3600 NS    ns1.example.com.
+example.com           300  A     192.0.2.1
+example.com.          300  a     192.0.2.2
+www.example.com.      60   CNAME example.com.
+example.com.          300  MX    10 mail.example.com.
+example.com.          120  TXT   v=spf1 ip4:192.0.2.0/24 -all
+_sip._udp.example.com. 30  SRV   10 5 5060 sip.example.com.
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 7 {
+		t.Fatalf("got %d records; want 7", len(records))
+	}
+	want := Record{Name: "example.com.", TTL: 120, Type: dnsmessage.TypeTXT, Data: "v=spf1 ip4:192.0.2.0/24 -all"}
+	if records[5] != want {
+		t.Errorf("got %+v; want %+v", records[5], want)
+	}
+
+	f, err := NewFromRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recordTests = []struct {
+		name    string
+		qtype   dnsmessage.Type
+		answers int
+		ttl     uint32
+	}{
+		{"example.com.", dnsmessage.TypeA, 2, 300},
+		{"example.com.", dnsmessage.TypeNS, 1, 3600},
+		{"www.example.com.", dnsmessage.TypeCNAME, 1, 60},
+		{"example.com.", dnsmessage.TypeMX, 1, 300},
+		{"example.com.", dnsmessage.TypeTXT, 1, 120},
+		{"_sip._udp.example.com.", dnsmessage.TypeSRV, 1, 30},
+		{"example.com.", dnsmessage.TypeAAAA, 0, 0},
+	}
+	for _, tt := range recordTests {
+		msg := exchange(t, f, tt.name, tt.qtype)
+		if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != tt.answers {
+			t.Errorf("%s %v: got %v with %d answers; want %d answers", tt.name, tt.qtype, msg.RCode, len(msg.Answers), tt.answers)
+			continue
+		}
+		for _, rr := range msg.Answers {
+			if rr.Header.TTL != tt.ttl {
+				t.Errorf("%s %v: got TTL %d; want %d", tt.name, tt.qtype, rr.Header.TTL, tt.ttl)
+			}
+		}
+	}
+	txt, err := NewMemoryResolver(f).LookupTXT(context.Background(), "example.com.")
+	if err != nil || len(txt) != 1 || txt[0] != "v=spf1 ip4:192.0.2.0/24 -all" {
+		t.Errorf("got %v %v; want the SPF record", txt, err)
+	}
+	if _, err := NewMemoryResolver(f).LookupHost(context.Background(), "missing.example.com."); err == nil {
+		t.Errorf("expected error for a name not present")
+	}
+}
+
+func TestParseRecordsTXT(t *testing.T) {
+	t.Parallel()
+	records, err := ParseRecords(`
+spf.example.com.    300 TXT "v=spf1 -all"
+multi.example.com.  300 TXT "first string"   "second \"quoted\" \\ string"
+plain.example.com.  300 TXT plain text
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFromRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var txtTests = []struct {
+		name string
+		txt  []string
+	}{
+		{"spf.example.com.", []string{"v=spf1 -all"}},
+		{"multi.example.com.", []string{"first string", `second "quoted" \ string`}},
+		{"plain.example.com.", []string{"plain text"}},
+	}
+	for _, tt := range txtTests {
+		msg := exchange(t, f, tt.name, dnsmessage.TypeTXT)
+		if len(msg.Answers) != 1 {
+			t.Errorf("%s: got %d answers; want 1", tt.name, len(msg.Answers))
+			continue
+		}
+		if txt := msg.Answers[0].Body.(*dnsmessage.TXTResource).TXT; !reflect.DeepEqual(txt, tt.txt) {
+			t.Errorf("%s: got %q; want %q", tt.name, txt, tt.txt)
+		}
+	}
+
+	for _, data := range []string{`"unterminated`, `"quoted" unquoted`, `"` + strings.Repeat("a", 256) + `"`} {
+		if _, err := NewFromRecords([]Record{{Name: "example.com.", TTL: 300, Type: dnsmessage.TypeTXT, Data: data}}); err == nil {
+			t.Errorf("%q: expected error", data)
+		}
+	}
+
+	// NewFromMap uses the same format, in a single TXT record
+	m, err := NewFromMap(map[string]map[dnsmessage.Type][]string{
+		"example.com.": {dnsmessage.TypeTXT: {`"first string" "second \"quoted\" \\ string"`, "plain text"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"first string", `second "quoted" \ string`, "plain text"}
+	msg := exchange(t, m, "example.com.", dnsmessage.TypeTXT)
+	if len(msg.Answers) != 1 {
+		t.Fatalf("got %d answers; want 1", len(msg.Answers))
+	}
+	if txt := msg.Answers[0].Body.(*dnsmessage.TXTResource).TXT; !reflect.DeepEqual(txt, want) {
+		t.Errorf("got %q; want %q", txt, want)
+	}
+}
+
+func TestParseRecordsInvalid(t *testing.T) {
+	t.Parallel()
+	for _, s := range []string{
+		"example.com. 300 A",
+		"example.com. ttl A 192.0.2.1",
+		"example.com. 300 HINFO cpu os",
+	} {
+		if _, err := ParseRecords(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+	records, err := ParseRecords("example.com. 300 A 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFromRecords(records); err == nil {
+		t.Errorf("expected error for an invalid A record")
+	}
+	records, err = ParseRecords(`
+www.example.com. 300 CNAME a.example.com.
+www.example.com. 300 CNAME b.example.com.
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFromRecords(records); err == nil {
+		t.Errorf("expected error for two CNAME records")
+	}
+}
+
+func TestNewFromRecordsRRset(t *testing.T) {
+	t.Parallel()
+	records, err := ParseRecords(`
+example.com. 300 A 192.0.2.1
+example.com. 300 A 192.0.2.1
+example.com. 300 A 192.0.2.2
+example.com. 300 A 192.0.2.3
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rrsetTests = []struct {
+		name    string
+		config  func(f *MemResolver)
+		rcode   dnsmessage.RCode
+		answers int
+	}{
+		{"dedup drop", func(f *MemResolver) {}, dnsmessage.RCodeSuccess, 3},
+		{"dedup keep", func(f *MemResolver) { f.DedupPolicy = DedupKeep }, dnsmessage.RCodeSuccess, 4},
+		{"dedup error", func(f *MemResolver) { f.DedupPolicy = DedupError }, dnsmessage.RCodeServerFailure, 0},
+		{"max records", func(f *MemResolver) { f.MaxRecordsPerRRset = 2 }, dnsmessage.RCodeSuccess, 2},
+		{"single answer", func(f *MemResolver) { f.SingleAnswer = true }, dnsmessage.RCodeSuccess, 1},
+	}
+	for _, tt := range rrsetTests {
+		f, err := NewFromRecords(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.config(f)
+		msg := exchange(t, f, "example.com.", dnsmessage.TypeA)
+		if msg.RCode != tt.rcode || len(msg.Answers) != tt.answers {
+			t.Errorf("%s: got %v with %d answers; want %v with %d", tt.name, msg.RCode, len(msg.Answers), tt.rcode, tt.answers)
+		}
+	}
+}
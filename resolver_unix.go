@@ -6,8 +6,14 @@ package resolver
 import (
 	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
 	"net"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aojea/hairpin"
 	"golang.org/x/net/dns/dnsmessage"
@@ -15,10 +21,77 @@ import (
 
 const ttl = 300
 
+var (
+	errFallback    = errors.New("fallback to the DefaultResolver is not allowed")
+	errNoRecursion = errors.New("recursion not desired")
+	errNoFallback  = errors.New("fallback to the DefaultResolver not used")
+	// errNotImplemented is returned by the lookup functions without
+	// a DefaultResolver counterpart.
+	errNotImplemented = errors.New("lookup not implemented")
+
+	// ErrNotHandled is returned by the Lookup function for the questions
+	// that have to be answered by the typed Lookup functions.
+	ErrNotHandled = errors.New("question not handled")
+	// ErrNoData is returned by the Lookup functions for the names that exist
+	// but have no records of the queried type, to answer NODATA. The Lookup
+	// functions returning no records, or a not found error, are answered with
+	// NXDOMAIN unless the other Lookup functions have records for the name.
+	ErrNoData = errors.New("no records of the queried type")
+)
+
+// obsoleteTypes are the obsolete record types, with their names since the
+// dnsmessage package does not know them.
+var obsoleteTypes = map[dnsmessage.Type]string{
+	3:  "MD",
+	4:  "MF",
+	7:  "MB",
+	8:  "MG",
+	9:  "MR",
+	10: "NULL",
+	38: "A6",
+}
+
+// questionKey is the context key for the question being answered.
+type questionKey struct{}
+
+// noRecursionKey is the context key set when the query does not allow
+// recursion.
+type noRecursionKey struct{}
+
+// noFallbackKey is the context key set for the lookups that check if a name
+// exists, that never use the DefaultResolver.
+type noFallbackKey struct{}
+
+// isNotFound returns true if err is a not found *net.DNSError.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// lookupErrorRCode returns the RCODE for the error of a Lookup function.
+func lookupErrorRCode(err error) dnsmessage.RCode {
+	if errors.Is(err, errNoRecursion) {
+		return dnsmessage.RCodeRefused
+	}
+	if isNotFound(err) {
+		return dnsmessage.RCodeNameError
+	}
+	if errors.Is(err, ErrNoData) {
+		return dnsmessage.RCodeSuccess
+	}
+	return dnsmessage.RCodeServerFailure
+}
+
 // MemResolver implement an in memory resolver that receives DNS questions and
 // executes the corresponding Lookup functions. If the corresponding Lookup
 // function is not present, it uses the DefaultResolver ones.
+//
+// The typed Lookup functions, like LookupIP or LookupTXT, receive the query
+// name in lower case, so they match the names case insensitively, while the
+// responses keep the exact case of the query (DNS 0x20 encoding).
 type MemResolver struct {
+	// LookupAddr receives the reverse name of the PTR queries, per example
+	// "1.2.0.192.in-addr.arpa.", not the address.
 	LookupAddr  func(ctx context.Context, addr string) (names []string, err error)
 	LookupCNAME func(ctx context.Context, host string) (cname string, err error)
 	LookupHost  func(ctx context.Context, host string) (addrs []string, err error)
@@ -29,50 +102,773 @@ type MemResolver struct {
 	LookupSRV   func(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
 	LookupTXT   func(ctx context.Context, name string) ([]string, error)
 	// Add new lookup functions here
-	// LookupSOA https://github.com/golang/go/issues/35061
 
+	// LookupSOA, if set, answers the SOA queries. The DefaultResolver has no
+	// SOA lookup https://github.com/golang/go/issues/35061, without it the
+	// SOA queries are NOTIMP.
+	LookupSOA func(ctx context.Context, name string) (*SOA, error)
+
+	// LookupNSEC3, if set, answers the NSEC3 queries. There is no fallback
+	// to the DefaultResolver, without it the NSEC3 queries are NOTIMP.
+	LookupNSEC3 func(ctx context.Context, name string) ([]*NSEC3, error)
+	// WeightedA answers the A queries for the configured names with its
+	// addresses, instead of using the LookupIP function.
+	WeightedA map[string][]WeightedIP
+	// SingleAnswer returns only one address per A query. The address is
+	// chosen randomly, according to the weights if the name is in WeightedA.
+	SingleAnswer bool
+	// DedupPolicy handles the duplicate records of the RRsets answered, also
+	// the ones returned by Lookup and LookupSections, by default they are
+	// dropped.
+	DedupPolicy DedupPolicy
+	// MaxRecordsPerRRset, if set, limits the number of records answered for
+	// each RRset of every section, the rest of the records returned by the
+	// Lookup functions, Lookup and LookupSections included, are omitted.
+	MaxRecordsPerRRset int
+	// ShuffleAnswers answers the records of each RRset in a random order for
+	// every query, using the Rand source.
+	ShuffleAnswers bool
+	// Rand is the source of randomness used by all the random features of
+	// the resolver, if nil a source seeded with the current time is used.
+	Rand rand.Source
+	// OnAmplification, if set, is called for every query with the length of
+	// the query and response messages, to measure the amplification factor.
+	// The TCP length prefix is not included.
+	OnAmplification func(queryLen, responseLen int)
+	// DropRate is the fraction of UDP queries, between 0 and 1, that are
+	// not answered at all, to emulate packet loss.
+	DropRate float64
+	// PostProcess, if set, can modify the encoded responses before they are
+	// sent, for TCP before adding the length prefix. It is meant to inject
+	// protocol level faults in tests.
+	PostProcess func(response []byte) []byte
+	// RejectReservedIPs answers SERVFAIL when the addresses returned by the
+	// Lookup functions are not valid host addresses: unspecified, multicast,
+	// broadcast or in 0.0.0.0/8 and 240.0.0.0/4.
+	RejectReservedIPs bool
+	// RFC6761 answers the queries for the localhost names and the loopback
+	// reverse names without using the Lookup functions, as per RFC 6761.
+	RFC6761 bool
+	// ResponseSize pads the responses to the queries with EDNS(0).
+	ResponseSize ResponseSize
+	// Views are alternative resolvers, indexed by view name, that answer the
+	// queries with an EDNS(0) option selecting the view. The option code is
+	// ViewOption, or DefaultViewOption if not set, and its data is the view
+	// name. The queries without the option, or for unknown views, are
+	// answered by this resolver.
+	Views      map[string]*MemResolver
+	ViewOption uint16
+	// TCPKeepalive, if set, is the idle timeout answered to the TCP queries
+	// with the EDNS(0) TCP Keepalive option, as per RFC 7828. The timeout is
+	// sent in units of 100 milliseconds.
+	TCPKeepalive time.Duration
+	// MaxUDPSize caps the UDP payload size advertised by the clients with
+	// EDNS(0), to limit the amplification. If zero DefaultMaxUDPSize is
+	// used, a negative value disables the cap. Values between 1 and 511 are
+	// ignored.
+	MaxUDPSize int
+	// DisableEDNS ignores the EDNS(0) OPT pseudo-record of the queries, the
+	// responses never contain it and are limited to 512 bytes over UDP, to
+	// emulate the servers that do not support EDNS(0).
+	DisableEDNS bool
+	// TTL is the TTL of the records in the answers, if zero the default TTL
+	// of 300 seconds is used.
+	TTL uint32
+	// TTLByType overrides the TTL of the records of the given types.
+	TTLByType map[dnsmessage.Type]uint32
+	// MinTTL, if set, raises the TTL of all the answered records to this
+	// value, including the records of the generic Lookup functions.
+	MinTTL uint32
+	// MaxTTL, if set, lowers the TTL of all the answered records to this
+	// value. It has precedence over MinTTL.
+	MaxTTL uint32
+	// TTLFunc, if set, returns the TTL of the answered records for the name,
+	// type and class of each record. It overrides all the other TTL sources,
+	// including the TTL of the generic Lookup records, and its values are not
+	// limited by MinTTL and MaxTTL.
+	TTLFunc func(q dnsmessage.Question) uint32
+
+	// FailOnFallback makes the queries fail with SERVFAIL instead of using
+	// the DefaultResolver when the corresponding Lookup function is not set.
+	FailOnFallback bool
+	// OnFallback, if set, is called with the question being answered before
+	// using the DefaultResolver.
+	OnFallback func(q dnsmessage.Question)
+	// HonorRecursionDesired only allows the DefaultResolver fallback for the
+	// queries with the RD bit set, the queries without it that need the
+	// fallback are REFUSED.
+	HonorRecursionDesired bool
+	// RejectZeroID answers FORMERR to the queries with ID 0, by default they
+	// are answered and the response echoes the ID.
+	RejectZeroID bool
+	// ValidateNames answers FORMERR to the queries whose question name
+	// contains NUL or other control characters.
+	ValidateNames bool
+	// OmitQuestion lists the names whose responses do not contain the
+	// question section. These responses are malformed, it is only meant to
+	// emulate buggy servers in tests.
+	OmitQuestion map[string]bool
+	// Router, if set, is consulted for every question that is not answered
+	// by the injected failures, the RFC6761 localhost names or the ChaosTXT.
+	// If it returns a Handler, the Handler produces the response instead of
+	// the resolvers and Lookup functions below.
+	Router Router
+	// RegexRoutes are evaluated in order after the Router, the Handler of the
+	// first route whose Pattern matches the lower case question name, with
+	// the trailing dot, produces the response.
+	RegexRoutes []RegexRoute
+
+	// FeatureGate, if set, selects per question the resolver that answers
+	// the questions not answered by the Router or the RegexRoutes:
+	// VariantResolver if it
+	// returns true and ControlResolver otherwise. If the selected resolver
+	// is nil the question is answered by this resolver.
+	FeatureGate     func(q dnsmessage.Question) bool
+	ControlResolver *MemResolver
+	VariantResolver *MemResolver
+	// WeightedViews, if set, answer each question not answered by the
+	// routes or the FeatureGate resolvers with one of the views, chosen
+	// randomly according to its weight.
+	WeightedViews []WeightedView
+	// LookupSections, if set, answers all the questions that are not
+	// answered by the routes, the FeatureGate resolvers or the WeightedViews
+	// with the records of each section of the response and the RCODE,
+	// instead of the Lookup functions.
+	LookupSections func(ctx context.Context, q dnsmessage.Question) (answer, authority, additional []dnsmessage.Resource, rcode dnsmessage.RCode)
+	// Lookup, if set, answers all the questions that are not answered by
+	// LookupSections or the ones before it with the records of the answer
+	// section and
+	// the RCODE. If it returns ErrNotHandled the typed Lookup functions
+	// answer the question, other errors are answered as the errors of the
+	// typed Lookup functions. Unlike the typed Lookup functions, it receives
+	// the question name with the case of the query.
+	Lookup func(ctx context.Context, q dnsmessage.Question) ([]dnsmessage.Resource, dnsmessage.RCode, error)
+	// CallbackTimeout, if set, limits the time to answer each question, so
+	// a Lookup function that does not return produces a SERVFAIL after the
+	// timeout. The context of the Lookup functions is canceled too.
+	CallbackTimeout time.Duration
+	// FailureDelay delays the SERVFAIL responses, to simulate the slow
+	// failures. The delay ends if the query context is canceled.
+	FailureDelay time.Duration
+
+	// DisableCompression disables the name compression in the responses to
+	// the queries of the given types.
+	DisableCompression map[dnsmessage.Type]bool
+	// Logf, if set, is used to log the events of the resolver.
+	Logf func(format string, args ...interface{})
+	// Now is the clock used by the resolver, if nil time.Now is used.
+	Now func() time.Time
+	// After is used by the resolver to wait for the delays, like the
+	// FailureDelay, if nil time.After is used.
+	After func(d time.Duration) <-chan time.Time
+	// OutageSchedule answers the queries received during the outages with
+	// the outage RCODE.
+	OutageSchedule []Outage
+	// ReadyAfter answers SERVFAIL to all the queries until this time has
+	// elapsed since the first query received by the resolver, to simulate
+	// a backend that is not ready at startup.
+	ReadyAfter time.Duration
+	// IncludeGlue adds the A and AAAA records of the SRV targets to the
+	// additional section of the SRV responses.
+	IncludeGlue bool
+	// TXTBeacon answers the TXT queries without records, or whose LookupTXT
+	// function returns a not found error, with the question name and the
+	// time of the query, to find the names resolved by the clients.
+	TXTBeacon bool
+	// TypeLatencyDist delays the answers of the queries of the given types
+	// by a latency drawn from a normal distribution, using the Rand source.
+	TypeLatencyDist map[dnsmessage.Type]LatencyDist
+	// ChaosTXT contains the TXT strings answered to the CHAOS class queries,
+	// indexed by name, per example "version.bind." or "hostname.bind.". If
+	// set, the CHAOS queries for other names are REFUSED.
+	ChaosTXT map[string][]string
+	// ColdCacheLatency delays the answer of the first query for each name,
+	// to simulate a cold cache. The next queries are answered immediately.
+	ColdCacheLatency time.Duration
+
+	mu               sync.Mutex // protects the fields below
+	rnd              *rand.Rand
+	fallbackAttempts uint64
+	start            time.Time
+	queried          map[string]bool
+	servfailOnce     map[string]bool
+	rotations        map[string]*rotation
+	lameZones        map[string]bool
+	trustAnchor      []DNSKEYRecord
+	appearing        map[string]*appearing
 }
 
-func (r *MemResolver) dnsStreamRoundTrip(b []byte) []byte {
-	// As per RFC 1035, TCP DNS messages are preceded by a 16 bit size, skip first 2 bytes.
-	b = b[2:]
+// appearing is a name that does not exist for the first queries.
+type appearing struct {
+	remaining int
+	ips       []net.IP
+}
 
-	var p dnsmessage.Parser
-	hdr, err := p.Start(b)
-	if err != nil {
-		return dnsErrorMessage(hdr.ID, dnsmessage.RCodeFormatError, dnsmessage.Question{})
+// rotation is a set of answers that changes every interval.
+type rotation struct {
+	start    time.Time
+	interval time.Duration
+	sets     [][]net.IP
+}
+
+// Outage is a period of time, relative to the first query received by the
+// resolver, where the queries are answered with RCode.
+type Outage struct {
+	Start time.Duration
+	End   time.Duration
+	RCode dnsmessage.RCode
+}
+
+// Handler produces the encoded DNS response for a question, ctx is the
+// context of the query. A MemResolver is a Handler, so the questions can be
+// delegated to another resolver.
+type Handler interface {
+	Answer(ctx context.Context, id uint16, q dnsmessage.Question) []byte
+}
+
+// HandlerFunc is an adapter to allow the use of ordinary functions as a
+// Handler.
+type HandlerFunc func(ctx context.Context, id uint16, q dnsmessage.Question) []byte
+
+// Answer calls f(ctx, id, q).
+func (f HandlerFunc) Answer(ctx context.Context, id uint16, q dnsmessage.Question) []byte {
+	return f(ctx, id, q)
+}
+
+// Router selects the Handler for a DNS question, it returns false if the
+// question has to be answered by the resolver Lookup functions.
+type Router interface {
+	Route(q dnsmessage.Question) (Handler, bool)
+}
+
+// DedupPolicy is the handling of the duplicate records of a RRset.
+type DedupPolicy int
+
+const (
+	// DedupDrop answers each record once.
+	DedupDrop DedupPolicy = iota
+	// DedupKeep answers the duplicate records.
+	DedupKeep
+	// DedupError answers SERVFAIL if a RRset has duplicate records.
+	DedupError
+)
+
+// RegexRoute is a Handler for the question names matching the Pattern.
+type RegexRoute struct {
+	Pattern *regexp.Regexp
+	Handler Handler
+}
+
+// LatencyDist is a normal distribution of latencies, the negative values are
+// handled as zero.
+type LatencyDist struct {
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+// WeightedIP is an IP address with the weight used to select it.
+type WeightedIP struct {
+	IP     net.IP
+	Weight int
+}
+
+// WeightedView is a resolver with the weight used to select it.
+type WeightedView struct {
+	Resolver *MemResolver
+	Weight   int
+}
+
+// canonicalName returns the lower case fully qualified form of name, so the
+// names configured in the resolver match the names in the DNS questions.
+func canonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
 	}
-	// Only support 1 question, ref:
-	// https://cs.opensource.google/go/x/net/+/e898025e:dns/dnsmessage/message.go
-	// Multiple questions are valid according to the spec,
-	// but servers don't actually support them. There will
-	// be at most one question here.
-	questions, err := p.AllQuestions()
-	if err != nil {
-		return dnsErrorMessage(hdr.ID, dnsmessage.RCodeFormatError, dnsmessage.Question{})
+	return name
+}
+
+// logf logs using the Logf function, if set.
+func (r *MemResolver) logf(format string, args ...interface{}) {
+	if r.Logf != nil {
+		r.Logf(format, args...)
 	}
-	if len(questions) > 1 {
-		return dnsErrorMessage(hdr.ID, dnsmessage.RCodeNotImplemented, dnsmessage.Question{})
-	} else if len(questions) == 0 {
-		return dnsErrorMessage(hdr.ID, dnsmessage.RCodeFormatError, dnsmessage.Question{})
+}
+
+// now returns the current time of the resolver clock.
+func (r *MemResolver) now() time.Time {
+	if r.Now != nil {
+		return r.Now()
+	}
+	return time.Now()
+}
+
+// after returns a channel that receives the time of the resolver clock after
+// the duration d.
+func (r *MemResolver) after(d time.Duration) <-chan time.Time {
+	if r.After != nil {
+		return r.After(d)
+	}
+	return time.After(d)
+}
+
+// uptime returns the time elapsed since the first query received by the
+// resolver.
+func (r *MemResolver) uptime() time.Duration {
+	now := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.start.IsZero() {
+		r.start = now
+	}
+	// the clock may go backwards
+	if now.Before(r.start) {
+		return 0
+	}
+	return now.Sub(r.start)
+}
+
+// firstQuery returns true the first time it is called for a name.
+func (r *MemResolver) firstQuery(name string) bool {
+	name = canonicalName(name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.queried[name] {
+		return false
+	}
+	if r.queried == nil {
+		r.queried = map[string]bool{}
+	}
+	r.queried[name] = true
+	return true
+}
+
+// ServfailOnce answers SERVFAIL to the next query for name, the following
+// queries are answered normally.
+func (r *MemResolver) ServfailOnce(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.servfailOnce == nil {
+		r.servfailOnce = map[string]bool{}
+	}
+	r.servfailOnce[canonicalName(name)] = true
+}
+
+// AppearsAfter answers NXDOMAIN to the first n queries for name, then the
+// address queries for name are answered with the addresses.
+func (r *MemResolver) AppearsAfter(name string, n int, ips ...net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.appearing == nil {
+		r.appearing = map[string]*appearing{}
+	}
+	r.appearing[canonicalName(name)] = &appearing{remaining: n, ips: ips}
+}
+
+// notAppeared returns true if name does not exist yet, counting the query.
+func (r *MemResolver) notAppeared(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.appearing[canonicalName(name)]
+	if !ok || a.remaining <= 0 {
+		return false
+	}
+	a.remaining--
+	return true
+}
+
+// appearedIPs returns the addresses of name if it was added by AppearsAfter.
+func (r *MemResolver) appearedIPs(name string) ([]net.IP, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.appearing[canonicalName(name)]
+	if !ok {
+		return nil, false
+	}
+	return a.ips, true
+}
+
+// LameDelegation makes the resolver REFUSE the queries for zone and the names
+// below it, emulating a lame delegation: a nameserver that is delegated the
+// zone by the parent, per example with the LookupNS function of another
+// MemResolver, but does not serve it.
+func (r *MemResolver) LameDelegation(zone string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lameZones == nil {
+		r.lameZones = map[string]bool{}
+	}
+	r.lameZones[canonicalName(zone)] = true
+}
+
+// isLame returns true if name is in a lame delegated zone.
+func (r *MemResolver) isLame(name string) bool {
+	name = canonicalName(name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for zone := range r.lameZones {
+		if inZone(name, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// inZone returns true if the canonical name is zone or a name below it.
+func inZone(name, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// takeServfailOnce returns true if the next query for name has to fail, and
+// clears the failure.
+func (r *MemResolver) takeServfailOnce(name string) bool {
+	name = canonicalName(name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.servfailOnce[name] {
+		return false
+	}
+	delete(r.servfailOnce, name)
+	return true
+}
+
+// RotateIPs answers the address queries for host with each set of addresses
+// in turn, advancing to the next set every interval according to the resolver
+// clock and starting with the first set now. It replaces the Lookup functions
+// for host.
+func (r *MemResolver) RotateIPs(host string, interval time.Duration, sets ...[]net.IP) {
+	now := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rotations == nil {
+		r.rotations = map[string]*rotation{}
+	}
+	r.rotations[canonicalName(host)] = &rotation{start: now, interval: interval, sets: sets}
+}
+
+// rotatingIPs returns the current set of addresses rotating for host.
+func (r *MemResolver) rotatingIPs(host string) ([]net.IP, bool) {
+	now := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rot, ok := r.rotations[canonicalName(host)]
+	if !ok || len(rot.sets) == 0 {
+		return nil, ok
+	}
+	i := 0
+	// the clock may go backwards, the first set is answered until the
+	// rotation starts
+	if elapsed := now.Sub(rot.start); rot.interval > 0 && elapsed > 0 {
+		i = int(elapsed/rot.interval) % len(rot.sets)
+	}
+	return rot.sets[i], true
+}
+
+// outage returns the RCODE of the outage in progress, if any.
+func (r *MemResolver) outage(uptime time.Duration) (dnsmessage.RCode, bool) {
+	for _, o := range r.OutageSchedule {
+		if uptime >= o.Start && uptime < o.End {
+			return o.RCode, true
+		}
+	}
+	return dnsmessage.RCodeSuccess, false
+}
+
+// WithRandSource sets the source of randomness used by the resolver, so the
+// random answers are reproducible, and returns the resolver.
+func (r *MemResolver) WithRandSource(src rand.Source) *MemResolver {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Rand = src
+	r.rnd = nil
+	return r
+}
+
+// intn returns a random number in [0,n) using the resolver source.
+func (r *MemResolver) intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.random().Intn(n)
+}
+
+// typeLatency returns a random latency for the queries of type t, as per the
+// TypeLatencyDist.
+func (r *MemResolver) typeLatency(t dnsmessage.Type) time.Duration {
+	dist, ok := r.TypeLatencyDist[t]
+	if !ok {
+		return 0
+	}
+	r.mu.Lock()
+	n := r.random().NormFloat64()
+	r.mu.Unlock()
+	latency := dist.Mean + time.Duration(n*float64(dist.StdDev))
+	if latency < 0 {
+		return 0
+	}
+	return latency
+}
+
+// float64 returns a random number in [0.0,1.0) using the resolver source.
+func (r *MemResolver) float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.random().Float64()
+}
+
+// order returns the indexes of the records of a RRset of length n that are
+// answered, in a random order for each query if ShuffleAnswers is set and up
+// to MaxRecordsPerRRset records. The records with the same key are handled
+// as per DedupPolicy, it returns false if the RRset must not be answered.
+func (r *MemResolver) order(n int, key func(i int) string) ([]int, bool) {
+	order := make([]int, 0, n)
+	seen := map[string]bool{}
+	for i := 0; i < n; i++ {
+		if r.DedupPolicy != DedupKeep {
+			k := key(i)
+			if seen[k] {
+				if r.DedupPolicy == DedupError {
+					r.logf("duplicate record %s", k)
+					return nil, false
+				}
+				continue
+			}
+			seen[k] = true
+		}
+		order = append(order, i)
+	}
+	if r.ShuffleAnswers {
+		r.mu.Lock()
+		r.random().Shuffle(len(order), func(i, j int) {
+			order[i], order[j] = order[j], order[i]
+		})
+		r.mu.Unlock()
+	}
+	if max := r.MaxRecordsPerRRset; max > 0 && len(order) > max {
+		order = order[:max]
+	}
+	return order, true
+}
+
+// random returns the random generator using the resolver source, r.mu must be
+// held.
+func (r *MemResolver) random() *rand.Rand {
+	if r.rnd == nil {
+		src := r.Rand
+		if src == nil {
+			src = rand.NewSource(time.Now().UnixNano())
+		}
+		r.rnd = rand.New(src)
+	}
+	return r.rnd
+}
+
+// recordTTL returns the TTL of the records of the question.
+func (r *MemResolver) recordTTL(q dnsmessage.Question) uint32 {
+	if r.TTLFunc != nil {
+		return r.TTLFunc(q)
+	}
+	if v, ok := r.TTLByType[q.Type]; ok {
+		return r.clampTTL(v)
+	}
+	if r.TTL != 0 {
+		return r.clampTTL(r.TTL)
+	}
+	return r.clampTTL(ttl)
+}
+
+// clampTTL returns the TTL limited by MinTTL and MaxTTL.
+func (r *MemResolver) clampTTL(v uint32) uint32 {
+	if v < r.MinTTL {
+		v = r.MinTTL
+	}
+	if r.MaxTTL > 0 && v > r.MaxTTL {
+		v = r.MaxTTL
 	}
+	return v
+}
+
+// omitQuestion returns true if the responses for name must not contain the
+// question section.
+func (r *MemResolver) omitQuestion(name string) bool {
+	name = canonicalName(name)
+	for n, omit := range r.OmitQuestion {
+		if canonicalName(n) == name {
+			return omit
+		}
+	}
+	return false
+}
+
+// weightedA returns the WeightedA addresses configured for host.
+func (r *MemResolver) weightedA(host string) ([]WeightedIP, bool) {
+	host = canonicalName(host)
+	for name, ips := range r.WeightedA {
+		if canonicalName(name) == host {
+			return ips, true
+		}
+	}
+	return nil, false
+}
+
+// regexRoute returns the Handler of the first RegexRoutes matching name.
+func (r *MemResolver) regexRoute(name string) (Handler, bool) {
+	name = canonicalName(name)
+	for _, route := range r.RegexRoutes {
+		if route.Pattern != nil && route.Handler != nil && route.Pattern.MatchString(name) {
+			return route.Handler, true
+		}
+	}
+	return nil, false
+}
+
+// chaosTXT returns the ChaosTXT strings configured for name.
+func (r *MemResolver) chaosTXT(name string) ([]string, bool) {
+	name = canonicalName(name)
+	for n, txt := range r.ChaosTXT {
+		if canonicalName(n) == name {
+			return txt, true
+		}
+	}
+	return nil, false
+}
+
+// weightedView returns the resolver of one of the WeightedViews chosen randomly
+// according to its weight, or nil if there are no views with weight.
+func (r *MemResolver) weightedView() *MemResolver {
+	total := 0
+	for _, v := range r.WeightedViews {
+		if v.Weight > 0 && v.Resolver != nil {
+			total += v.Weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	n := r.intn(total)
+	for _, v := range r.WeightedViews {
+		if v.Weight <= 0 || v.Resolver == nil {
+			continue
+		}
+		if n < v.Weight {
+			return v.Resolver
+		}
+		n -= v.Weight
+	}
+	return nil
+}
+
+// pickWeighted returns one address chosen randomly according to its weight.
+func (r *MemResolver) pickWeighted(ips []WeightedIP) net.IP {
+	total := 0
+	for _, w := range ips {
+		if w.Weight > 0 {
+			total += w.Weight
+		}
+	}
+	if total == 0 {
+		return ips[r.intn(len(ips))].IP
+	}
+	n := r.intn(total)
+	for _, w := range ips {
+		if w.Weight <= 0 {
+			continue
+		}
+		if n < w.Weight {
+			return w.IP
+		}
+		n -= w.Weight
+	}
+	return ips[len(ips)-1].IP
+}
+
+// lookupA returns the addresses used to answer an A query.
+func (r *MemResolver) lookupA(ctx context.Context, host string) ([]net.IP, error) {
+	if weighted, ok := r.weightedA(host); ok {
+		if len(weighted) == 0 {
+			return nil, nil
+		}
+		if r.SingleAnswer {
+			return []net.IP{r.pickWeighted(weighted)}, nil
+		}
+		addrs := make([]net.IP, len(weighted))
+		for i, w := range weighted {
+			addrs[i] = w.IP
+		}
+		return addrs, nil
+	}
+	addrs, err := r.lookupIP(ctx, "ip4", host)
+	if err != nil || !r.SingleAnswer {
+		return addrs, err
+	}
+	ipv4 := []net.IP{}
+	for _, ip := range addrs {
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip)
+		}
+	}
+	if len(ipv4) == 0 {
+		// the addresses of the other family show that the name exists
+		return addrs, nil
+	}
+	return []net.IP{ipv4[r.intn(len(ipv4))]}, nil
+}
 
-	b = r.processDNSRequest(hdr.ID, questions[0])
+func (r *MemResolver) dnsStreamRoundTrip(b []byte) []byte {
+	// As per RFC 1035, TCP DNS messages are preceded by a 16 bit size, skip first 2 bytes.
+	// The messages are not buffered across writes, so a message shorter
+	// than its length prefix is not answered, as a zero length.
+	if len(b) < 2 {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if n == 0 || len(b)-2 < n {
+		return nil
+	}
+	b = r.dnsRoundTrip(b[2:2+n], false)
 	hdrLen := make([]byte, 2)
 	binary.BigEndian.PutUint16(hdrLen, uint16(len(b)))
 	return append(hdrLen, b...)
 }
 
 func (r *MemResolver) dnsPacketRoundTrip(b []byte) []byte {
+	if r.DropRate > 0 && r.float64() < r.DropRate {
+		return nil
+	}
+	return r.dnsRoundTrip(b, true)
+}
+
+// dnsRoundTrip processes a DNS query message and returns the encoded response.
+// UDP messages are limited to 512 bytes as per RFC 1035.
+func (r *MemResolver) dnsRoundTrip(b []byte, udp bool) (answer []byte) {
+	defer func() {
+		// The responses echo the CD (Checking Disabled) bit of the query,
+		// the resolver does not validate so it does not change the answer.
+		// dnsmessage does not support it, it is the bit 4 of the fourth
+		// byte of the header.
+		if len(b) > 3 && len(answer) > 3 && b[3]&0x10 != 0 {
+			answer[3] |= 0x10
+		}
+		if r.PostProcess != nil {
+			answer = r.PostProcess(answer)
+		}
+		if r.OnAmplification != nil {
+			r.OnAmplification(len(b), len(answer))
+		}
+	}()
+
 	var p dnsmessage.Parser
 	hdr, err := p.Start(b)
 	if err != nil {
 		return dnsErrorMessage(hdr.ID, dnsmessage.RCodeFormatError, dnsmessage.Question{})
 	}
 	// RFC1035 max 512 bytes for UDP
-	if len(b) > 512 {
+	if udp && len(b) > 512 {
 		return dnsErrorMessage(hdr.ID, dnsmessage.RCodeFormatError, dnsmessage.Question{})
 	}
+	// Only standard queries are supported, the response echoes the OPCODE
+	if hdr.OpCode != 0 {
+		return dnsOpCodeErrorMessage(hdr.ID, hdr.OpCode)
+	}
 
 	// Only support 1 question, ref:
 	// https://cs.opensource.google/go/x/net/+/e898025e:dns/dnsmessage/message.go
@@ -88,47 +884,312 @@ func (r *MemResolver) dnsPacketRoundTrip(b []byte) []byte {
 	} else if len(questions) == 0 {
 		return dnsErrorMessage(hdr.ID, dnsmessage.RCodeFormatError, dnsmessage.Question{})
 	}
+	if r.RejectZeroID && hdr.ID == 0 {
+		r.logf("query with ID 0 for %s rejected", questions[0].Name)
+		return dnsErrorMessage(hdr.ID, dnsmessage.RCodeFormatError, questions[0])
+	}
+	if r.ValidateNames && !validName(questions[0].Name) {
+		r.logf("invalid question name %q", questions[0].Name)
+		return dnsErrorMessage(hdr.ID, dnsmessage.RCodeFormatError, questions[0])
+	}
+
+	e, err := parseEDNS(&p)
+	if err != nil {
+		return dnsErrorMessage(hdr.ID, dnsmessage.RCodeFormatError, questions[0])
+	}
+	// The parser ignores the bytes after the sections declared in the header
+	if n, ok := messageLen(b); !ok || n != len(b) {
+		r.logf("query with trailing data for %s rejected", questions[0].Name)
+		return dnsErrorMessage(hdr.ID, dnsmessage.RCodeFormatError, questions[0])
+	}
+	// Servers without EDNS(0) support ignore the OPT pseudo-record
+	if r.DisableEDNS {
+		e = nil
+	}
+	// Only EDNS version 0 is supported, as per RFC 6891 the response
+	// contains the version supported by the server.
+	if e != nil && e.version > 0 {
+		msg := dnsErrorMessage(hdr.ID, rcodeBadVers&0xF, questions[0])
+		return appendOPT(msg, e.udpSize, rcodeBadVers, e.dnssecOK, nil)
+	}
+
+	ctx := context.Background()
+	if r.HonorRecursionDesired && !hdr.RecursionDesired {
+		ctx = context.WithValue(ctx, noRecursionKey{}, true)
+	}
+	answer = r.view(e).processDNSRequestContext(ctx, hdr.ID, questions[0])
+	// RFC1035 max 512 bytes for UDP, TCP messages are limited by the 16 bit
+	// length prefix.
+	limit := 512
+	if !udp {
+		limit = 65535
+	}
+	if e == nil {
+		// Return a truncated packet if the answer is too big
+		if len(answer) > limit {
+			answer = dnsTruncatedMessage(hdr.ID, questions[0])
+		}
+		return answer
+	}
+
+	// EDNS(0) allows bigger UDP messages, up to the advertised size
+	if udp {
+		maxUDPSize := r.MaxUDPSize
+		if maxUDPSize == 0 {
+			maxUDPSize = DefaultMaxUDPSize
+		}
+		if maxUDPSize >= 512 && e.udpSize > maxUDPSize {
+			e.udpSize = maxUDPSize
+		}
+		limit = e.udpSize
+	}
+	if len(answer)+optLen(nil) > limit {
+		return appendOPT(dnsTruncatedMessage(hdr.ID, questions[0]), e.udpSize, dnsmessage.RCodeSuccess, e.dnssecOK, nil)
+	}
+	var options []dnsmessage.Option
+	if !udp && r.TCPKeepalive > 0 && e.hasOption(ednsOptionTCPKeepalive) {
+		options = append(options, keepaliveOption(r.TCPKeepalive))
+	}
+	// the Padding option is the last one, so it accounts for the others
+	if target := r.ResponseSize.Target; target > 0 {
+		if target > limit {
+			target = limit
+		}
+		if padding, ok := paddingOption(len(answer)+optLen(options)-optLen(nil), target); ok {
+			options = append(options, padding)
+		}
+	}
+	return appendOPT(answer, e.udpSize, dnsmessage.RCodeSuccess, e.dnssecOK, options)
+}
+
+// messageLen returns the length of the encoded message, up to the end of the
+// last record of the sections declared in the header. It returns false if the
+// message is shorter than the sections.
+func messageLen(b []byte) (int, bool) {
+	if len(b) < 12 {
+		return 0, false
+	}
+	qdcount := int(binary.BigEndian.Uint16(b[4:6]))
+	rrcount := int(binary.BigEndian.Uint16(b[6:8])) + int(binary.BigEndian.Uint16(b[8:10])) + int(binary.BigEndian.Uint16(b[10:12]))
+	off := 12
+	var ok bool
+	for i := 0; i < qdcount; i++ {
+		if off, ok = skipName(b, off); !ok {
+			return 0, false
+		}
+		off += 4 // type and class
+	}
+	for i := 0; i < rrcount; i++ {
+		if off, ok = skipName(b, off); !ok {
+			return 0, false
+		}
+		off += 10 // type, class, ttl and rdata length
+		if off > len(b) {
+			return 0, false
+		}
+		off += int(binary.BigEndian.Uint16(b[off-2 : off]))
+	}
+	if off > len(b) {
+		return 0, false
+	}
+	return off, true
+}
+
+// skipName returns the offset following the encoded name at off.
+func skipName(b []byte, off int) (int, bool) {
+	for off < len(b) {
+		c := int(b[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				return off + 1, true
+			}
+			off += 1 + c
+		case 0xC0:
+			// compression pointer, the end of the name
+			return off + 2, off+2 <= len(b)
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// dnsErrorMessage return an encoded dns error message, the question section is
+// empty if the question is not valid.
+func dnsErrorMessage(id uint16, rcode dnsmessage.RCode, q dnsmessage.Question) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:            id,
+			Response:      true,
+			Authoritative: true,
+			RCode:         rcode,
+		},
+	}
+	if q.Name.Length > 0 {
+		msg.Questions = []dnsmessage.Question{q}
+	}
+	buf, err := msg.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+// dnsOpCodeErrorMessage return an encoded NOTIMP message for a not supported
+// OPCODE.
+func dnsOpCodeErrorMessage(id uint16, opCode dnsmessage.OpCode) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:            id,
+			Response:      true,
+			OpCode:        opCode,
+			Authoritative: true,
+			RCode:         dnsmessage.RCodeNotImplemented,
+		},
+	}
+	buf, err := msg.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+func dnsTruncatedMessage(id uint16, q dnsmessage.Question) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:            id,
+			Response:      true,
+			Authoritative: true,
+			Truncated:     true,
+		},
+		Questions: []dnsmessage.Question{q},
+	}
+	buf, err := msg.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+// localhostReverse6 is the reverse name of the IPv6 loopback address.
+const localhostReverse6 = "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa."
+
+// reservedIPv4 are the IPv4 ranges that can not be assigned to hosts.
+var reservedIPv4 = []*net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(240, 0, 0, 0), Mask: net.CIDRMask(4, 32)},
+}
+
+// isReservedIP returns true if ip is not a valid host address.
+func isReservedIP(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+		return true
+	}
+	for _, n := range reservedIPv4 {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
 
-	answer := r.processDNSRequest(hdr.ID, questions[0])
-	// Return a truncated packet if the answer is too big
-	if len(answer) > 512 {
-		answer = dnsTruncatedMessage(hdr.ID, questions[0])
+// validName returns true if the name does not contain NUL or other control
+// characters.
+func validName(n dnsmessage.Name) bool {
+	if n.Length == 0 {
+		return false
+	}
+	for _, c := range n.Data[:n.Length] {
+		if c < 0x20 || c == 0x7f {
+			return false
+		}
 	}
+	return true
+}
 
-	return answer
+// isLocalhost returns true if name is a localhost name or a loopback reverse
+// name, that are special names as per RFC 6761 section 6.3.
+func isLocalhost(name string) bool {
+	name = canonicalName(name)
+	return name == "localhost." ||
+		strings.HasSuffix(name, ".localhost.") ||
+		strings.HasSuffix(name, ".127.in-addr.arpa.") ||
+		name == localhostReverse6
 }
 
-// dnsErrorMessage return an encoded dns error message
-func dnsErrorMessage(id uint16, rcode dnsmessage.RCode, q dnsmessage.Question) []byte {
+// localhostMessage returns the encoded answer for a localhost name: the
+// loopback addresses for address queries, localhost for the loopback reverse
+// names and a negative response for any other query.
+func (r *MemResolver) localhostMessage(id uint16, q dnsmessage.Question) []byte {
 	msg := dnsmessage.Message{
 		Header: dnsmessage.Header{
 			ID:            id,
 			Response:      true,
 			Authoritative: true,
-			RCode:         rcode,
 		},
 		Questions: []dnsmessage.Question{q},
 	}
+	hdr := dnsmessage.ResourceHeader{
+		Name:  q.Name,
+		Type:  q.Type,
+		Class: q.Class,
+		TTL:   r.recordTTL(q),
+	}
+	name := canonicalName(q.Name.String())
+	reverse := strings.HasSuffix(name, ".arpa.")
+	switch {
+	case q.Type == dnsmessage.TypeA && !reverse:
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: hdr,
+			Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+		})
+	case q.Type == dnsmessage.TypeAAAA && !reverse:
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: hdr,
+			Body:   &dnsmessage.AAAAResource{AAAA: [16]byte{15: 1}},
+		})
+	case q.Type == dnsmessage.TypePTR && reverse:
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: hdr,
+			Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName("localhost.")},
+		})
+	}
 	buf, err := msg.Pack()
 	if err != nil {
-		panic(err)
+		return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
 	}
 	return buf
 }
 
-func dnsTruncatedMessage(id uint16, q dnsmessage.Question) []byte {
+// chaosMessage returns the encoded answer for a CHAOS class question, with
+// the TXT strings configured for the name or REFUSED if there are none.
+func (r *MemResolver) chaosMessage(id uint16, q dnsmessage.Question) []byte {
+	txt, ok := r.chaosTXT(q.Name.String())
+	if !ok {
+		return dnsErrorMessage(id, dnsmessage.RCodeRefused, q)
+	}
 	msg := dnsmessage.Message{
 		Header: dnsmessage.Header{
 			ID:            id,
 			Response:      true,
 			Authoritative: true,
-			Truncated:     true,
 		},
 		Questions: []dnsmessage.Question{q},
 	}
+	if q.Type == dnsmessage.TypeTXT && len(txt) > 0 {
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  q.Name,
+				Type:  q.Type,
+				Class: q.Class,
+			},
+			Body: &dnsmessage.TXTResource{TXT: txt},
+		})
+	}
 	buf, err := msg.Pack()
 	if err != nil {
-		panic(err)
+		return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
 	}
 	return buf
 }
@@ -136,6 +1197,123 @@ func dnsTruncatedMessage(id uint16, q dnsmessage.Question) []byte {
 // processDNSRequest implements dnsHandlerFunc so it can be used in a MemResolver
 // transforming a DNS request to the corresponding Golang Lookup functions.
 func (r *MemResolver) processDNSRequest(id uint16, q dnsmessage.Question) []byte {
+	return r.processDNSRequestContext(context.Background(), id, q)
+}
+
+// Answer implements Handler, it returns the encoded response of the resolver
+// for the question.
+func (r *MemResolver) Answer(ctx context.Context, id uint16, q dnsmessage.Question) []byte {
+	return r.processDNSRequestContext(ctx, id, q)
+}
+
+// processDNSRequestContext is processDNSRequest using ctx for the Lookup
+// functions.
+func (r *MemResolver) processDNSRequestContext(ctx context.Context, id uint16, q dnsmessage.Question) []byte {
+	answer := r.answerWithTimeout(ctx, id, q)
+	// the failures are slowed down, the RCODE is in the low 4 bits of the
+	// fourth byte of the header
+	if r.FailureDelay > 0 && len(answer) > 3 && dnsmessage.RCode(answer[3]&0xF) == dnsmessage.RCodeServerFailure {
+		select {
+		case <-ctx.Done():
+		case <-r.after(r.FailureDelay):
+		}
+	}
+	return answer
+}
+
+// answerWithTimeout returns the encoded response for the question, or SERVFAIL
+// if it is not answered before the CallbackTimeout.
+func (r *MemResolver) answerWithTimeout(ctx context.Context, id uint16, q dnsmessage.Question) []byte {
+	if r.CallbackTimeout <= 0 {
+		return r.answerQuestion(ctx, id, q)
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.CallbackTimeout)
+	defer cancel()
+	// buffered so the goroutine of a hung callback can finish later
+	ch := make(chan []byte, 1)
+	go func() {
+		ch <- r.answerQuestion(ctx, id, q)
+	}()
+	select {
+	case answer := <-ch:
+		return answer
+	case <-ctx.Done():
+		r.logf("timeout answering %v %v", q.Name, q.Type)
+		return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+	}
+}
+
+// answerQuestion returns the encoded response for the question.
+func (r *MemResolver) answerQuestion(ctx context.Context, id uint16, q dnsmessage.Question) []byte {
+	uptime := r.uptime()
+	if rcode, ok := r.outage(uptime); ok {
+		return dnsErrorMessage(id, rcode, q)
+	}
+	if uptime < r.ReadyAfter {
+		return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+	}
+	if r.takeServfailOnce(q.Name.String()) {
+		return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+	}
+	if r.notAppeared(q.Name.String()) {
+		return dnsErrorMessage(id, dnsmessage.RCodeNameError, q)
+	}
+	if r.isLame(q.Name.String()) {
+		return dnsErrorMessage(id, dnsmessage.RCodeRefused, q)
+	}
+	if r.ColdCacheLatency > 0 && r.firstQuery(q.Name.String()) {
+		select {
+		case <-ctx.Done():
+			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+		case <-r.after(r.ColdCacheLatency):
+		}
+	}
+	if latency := r.typeLatency(q.Type); latency > 0 {
+		select {
+		case <-ctx.Done():
+			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+		case <-r.after(latency):
+		}
+	}
+	if r.RFC6761 && isLocalhost(q.Name.String()) {
+		return r.localhostMessage(id, q)
+	}
+	if r.ChaosTXT != nil && q.Class == dnsmessage.ClassCHAOS {
+		return r.chaosMessage(id, q)
+	}
+	if r.Router != nil {
+		if h, ok := r.Router.Route(q); ok {
+			return h.Answer(ctx, id, q)
+		}
+	}
+	if h, ok := r.regexRoute(q.Name.String()); ok {
+		return h.Answer(ctx, id, q)
+	}
+	if r.FeatureGate != nil {
+		selected := r.ControlResolver
+		if r.FeatureGate(q) {
+			selected = r.VariantResolver
+		}
+		if selected != nil {
+			return selected.processDNSRequestContext(ctx, id, q)
+		}
+	}
+	if v := r.weightedView(); v != nil {
+		return v.processDNSRequestContext(ctx, id, q)
+	}
+	if r.LookupSections != nil {
+		answers, authorities, additionals, rcode := r.LookupSections(ctx, q)
+		return r.sectionsMessage(id, q, rcode, answers, authorities, additionals)
+	}
+	if r.Lookup != nil {
+		answers, rcode, err := r.Lookup(ctx, q)
+		if err == nil {
+			return r.sectionsMessage(id, q, rcode, answers, nil, nil)
+		}
+		if !errors.Is(err, ErrNotHandled) {
+			return dnsErrorMessage(id, lookupErrorRCode(err), q)
+		}
+	}
 	// DNS packet length is encoded in 2 bytes
 	buf := []byte{}
 	answer := dnsmessage.NewBuilder(buf,
@@ -144,32 +1322,57 @@ func (r *MemResolver) processDNSRequest(id uint16, q dnsmessage.Question) []byte
 			Response:      true,
 			Authoritative: true,
 		})
-	answer.EnableCompression()
+	// The question name is always uncompressed, since it is the first name
+	// of the message.
+	if !r.DisableCompression[q.Type] {
+		answer.EnableCompression()
+	}
 	err := answer.StartQuestions()
 	if err != nil {
 		return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
 	}
-	answer.Question(q)
+	if !r.omitQuestion(q.Name.String()) {
+		answer.Question(q)
+	}
 	err = answer.StartAnswers()
 	if err != nil {
 		return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
 	}
+	ctx = context.WithValue(ctx, questionKey{}, q)
+	// The Lookup functions match the names case insensitively, the
+	// responses preserve the case of the question (DNS 0x20 encoding).
+	name := strings.ToLower(q.Name.String())
+	// exists is set if the lookup shows that the name exists, so an answer
+	// without records is NODATA instead of NXDOMAIN.
+	var exists bool
 	switch q.Type {
 	case dnsmessage.TypeA:
-		addrs, err := r.lookupIP(context.Background(), "ip4", q.Name.String())
+		addrs, err := r.lookupA(ctx, name)
 		if err != nil {
+			return r.lookupErrorMessage(ctx, id, q, name, err)
+		}
+		// the lookup may return the addresses of the other family, they
+		// are not answered but show that the name exists
+		exists = len(addrs) > 0
+		order, ok := r.order(len(addrs), func(i int) string { return addrs[i].String() })
+		if !ok {
 			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
 		}
-		for _, ip := range addrs {
+		for _, i := range order {
+			ip := addrs[i]
 			a := ip.To4()
 			if a == nil {
 				continue
 			}
+			if r.RejectReservedIPs && isReservedIP(ip) {
+				r.logf("reserved address %v for %s rejected", ip, name)
+				return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+			}
 			err = answer.AResource(
 				dnsmessage.ResourceHeader{
 					Name:  q.Name,
 					Class: q.Class,
-					TTL:   ttl,
+					TTL:   r.recordTTL(q),
 				},
 				dnsmessage.AResource{
 					A: [4]byte{a[0], a[1], a[2], a[3]},
@@ -180,21 +1383,33 @@ func (r *MemResolver) processDNSRequest(id uint16, q dnsmessage.Question) []byte
 			}
 		}
 	case dnsmessage.TypeAAAA:
-		addrs, err := r.lookupIP(context.Background(), "ip6", q.Name.String())
+		addrs, err := r.lookupIP(ctx, "ip6", name)
 		if err != nil {
+			return r.lookupErrorMessage(ctx, id, q, name, err)
+		}
+		// the lookup may return the addresses of the other family, they
+		// are not answered but show that the name exists
+		exists = len(addrs) > 0
+		order, ok := r.order(len(addrs), func(i int) string { return addrs[i].String() })
+		if !ok {
 			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
 		}
-		for _, ip := range addrs {
+		for _, i := range order {
+			ip := addrs[i]
 			if ip.To16() == nil || ip.To4() != nil {
 				continue
 			}
+			if r.RejectReservedIPs && isReservedIP(ip) {
+				r.logf("reserved address %v for %s rejected", ip, name)
+				return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+			}
 			var aaaa [16]byte
 			copy(aaaa[:], ip.To16())
 			err = answer.AAAAResource(
 				dnsmessage.ResourceHeader{
 					Name:  q.Name,
 					Class: q.Class,
-					TTL:   ttl,
+					TTL:   r.recordTTL(q),
 				},
 				dnsmessage.AAAAResource{
 					AAAA: aaaa,
@@ -205,11 +1420,16 @@ func (r *MemResolver) processDNSRequest(id uint16, q dnsmessage.Question) []byte
 			}
 		}
 	case dnsmessage.TypeNS:
-		nsList, err := r.lookupNS(context.Background(), q.Name.String())
+		nsList, err := r.lookupNS(ctx, name)
 		if err != nil {
+			return r.lookupErrorMessage(ctx, id, q, name, err)
+		}
+		order, ok := r.order(len(nsList), func(i int) string { return canonicalName(nsList[i].Host) })
+		if !ok {
 			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
 		}
-		for _, ns := range nsList {
+		for _, i := range order {
+			ns := nsList[i]
 			name, err := dnsmessage.NewName(ns.Host)
 			if err != nil {
 				return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
@@ -218,7 +1438,7 @@ func (r *MemResolver) processDNSRequest(id uint16, q dnsmessage.Question) []byte
 				dnsmessage.ResourceHeader{
 					Name:  q.Name,
 					Class: q.Class,
-					TTL:   ttl,
+					TTL:   r.recordTTL(q),
 				},
 				dnsmessage.NSResource{
 					NS: name,
@@ -229,9 +1449,9 @@ func (r *MemResolver) processDNSRequest(id uint16, q dnsmessage.Question) []byte
 			}
 		}
 	case dnsmessage.TypeCNAME:
-		cname, err := r.lookupCNAME(context.Background(), q.Name.String())
+		cname, err := r.lookupCNAME(ctx, name)
 		if err != nil {
-			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+			return r.lookupErrorMessage(ctx, id, q, name, err)
 		}
 		name, err := dnsmessage.NewName(cname)
 		if err != nil {
@@ -241,7 +1461,7 @@ func (r *MemResolver) processDNSRequest(id uint16, q dnsmessage.Question) []byte
 			dnsmessage.ResourceHeader{
 				Name:  q.Name,
 				Class: q.Class,
-				TTL:   ttl,
+				TTL:   r.recordTTL(q),
 			},
 			dnsmessage.CNAMEResource{
 				CNAME: name,
@@ -251,13 +1471,55 @@ func (r *MemResolver) processDNSRequest(id uint16, q dnsmessage.Question) []byte
 			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
 		}
 	case dnsmessage.TypeSOA:
-		// TODO
+		soa, err := r.lookupSOA(ctx, name)
+		if errors.Is(err, errNotImplemented) {
+			r.logf("query type SOA for %s not implemented", q.Name)
+			return dnsErrorMessage(id, dnsmessage.RCodeNotImplemented, q)
+		}
+		if err != nil {
+			return r.lookupErrorMessage(ctx, id, q, name, err)
+		}
+		if soa == nil {
+			break
+		}
+		ns, err := dnsmessage.NewName(soa.NS)
+		if err != nil {
+			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+		}
+		mbox, err := dnsmessage.NewName(soa.Mbox)
+		if err != nil {
+			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+		}
+		err = answer.SOAResource(
+			dnsmessage.ResourceHeader{
+				Name:  q.Name,
+				Class: q.Class,
+				TTL:   r.recordTTL(q),
+			},
+			dnsmessage.SOAResource{
+				NS:      ns,
+				MBox:    mbox,
+				Serial:  soa.Serial,
+				Refresh: soa.Refresh,
+				Retry:   soa.Retry,
+				Expire:  soa.Expire,
+				MinTTL:  soa.MinTTL,
+			},
+		)
+		if err != nil {
+			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+		}
 	case dnsmessage.TypeMX:
-		mxList, err := r.lookupMX(context.Background(), q.Name.String())
+		mxList, err := r.lookupMX(ctx, name)
 		if err != nil {
+			return r.lookupErrorMessage(ctx, id, q, name, err)
+		}
+		order, ok := r.order(len(mxList), func(i int) string { return fmt.Sprintf("%d %s", mxList[i].Pref, canonicalName(mxList[i].Host)) })
+		if !ok {
 			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
 		}
-		for _, mx := range mxList {
+		for _, i := range order {
+			mx := mxList[i]
 			name, err := dnsmessage.NewName(mx.Host)
 			if err != nil {
 				return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
@@ -266,7 +1528,7 @@ func (r *MemResolver) processDNSRequest(id uint16, q dnsmessage.Question) []byte
 				dnsmessage.ResourceHeader{
 					Name:  q.Name,
 					Class: q.Class,
-					TTL:   ttl,
+					TTL:   r.recordTTL(q),
 				},
 				dnsmessage.MXResource{
 					MX:   name,
@@ -280,15 +1542,24 @@ func (r *MemResolver) processDNSRequest(id uint16, q dnsmessage.Question) []byte
 	case dnsmessage.TypeTXT:
 		// You can enter a value of up to 255 characters in one string in a TXT record.
 		// You can add multiple strings of 255 characters in a single TXT record.
-		txt, err := r.lookupTXT(context.Background(), q.Name.String())
+		var txt []string
+		if !r.TXTBeacon || r.LookupTXT != nil {
+			txt, err = r.lookupTXT(ctx, name)
+		}
+		if r.TXTBeacon && ((len(txt) == 0 && err == nil) || isNotFound(err) || errors.Is(err, ErrNoData)) {
+			txt, err = []string{q.Name.String(), r.now().UTC().Format(time.RFC3339Nano)}, nil
+		}
 		if err != nil {
-			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+			return r.lookupErrorMessage(ctx, id, q, name, err)
+		}
+		if len(txt) == 0 {
+			break
 		}
 		err = answer.TXTResource(
 			dnsmessage.ResourceHeader{
 				Name:  q.Name,
 				Class: q.Class,
-				TTL:   ttl,
+				TTL:   r.recordTTL(q),
 			},
 			dnsmessage.TXTResource{
 				TXT: txt,
@@ -299,11 +1570,21 @@ func (r *MemResolver) processDNSRequest(id uint16, q dnsmessage.Question) []byte
 		}
 	case dnsmessage.TypeSRV:
 		// WIP
-		_, srvList, err := r.lookupSRV(context.Background(), "", "", q.Name.String())
+		_, srvList, err := r.lookupSRV(ctx, "", "", name)
 		if err != nil {
+			return r.lookupErrorMessage(ctx, id, q, name, err)
+		}
+		order, ok := r.order(len(srvList), func(i int) string {
+			return fmt.Sprintf("%d %d %d %s", srvList[i].Priority, srvList[i].Weight, srvList[i].Port, canonicalName(srvList[i].Target))
+		})
+		if !ok {
 			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
 		}
-		for _, srv := range srvList {
+		// only the targets of the answered records have glue
+		answered := make([]*net.SRV, 0, len(order))
+		for _, i := range order {
+			srv := srvList[i]
+			answered = append(answered, srv)
 			target, err := dnsmessage.NewName(srv.Target)
 			if err != nil {
 				return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
@@ -312,7 +1593,7 @@ func (r *MemResolver) processDNSRequest(id uint16, q dnsmessage.Question) []byte
 				dnsmessage.ResourceHeader{
 					Name:  q.Name,
 					Class: q.Class,
-					TTL:   ttl,
+					TTL:   r.recordTTL(q),
 				},
 				dnsmessage.SRVResource{
 					Target:   target,
@@ -325,12 +1606,22 @@ func (r *MemResolver) processDNSRequest(id uint16, q dnsmessage.Question) []byte
 				return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
 			}
 		}
+		if r.IncludeGlue {
+			if err := r.addGlue(ctx, &answer, q.Class, answered); err != nil {
+				return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+			}
+		}
 	case dnsmessage.TypePTR:
-		names, err := r.LookupAddr(context.Background(), q.Name.String())
+		names, err := r.lookupAddr(ctx, name)
 		if err != nil {
+			return r.lookupErrorMessage(ctx, id, q, name, err)
+		}
+		order, ok := r.order(len(names), func(i int) string { return canonicalName(names[i]) })
+		if !ok {
 			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
 		}
-		for _, n := range names {
+		for _, i := range order {
+			n := names[i]
 			name, err := dnsmessage.NewName(n)
 			if err != nil {
 				return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
@@ -339,7 +1630,7 @@ func (r *MemResolver) processDNSRequest(id uint16, q dnsmessage.Question) []byte
 				dnsmessage.ResourceHeader{
 					Name:  q.Name,
 					Class: q.Class,
-					TTL:   ttl,
+					TTL:   r.recordTTL(q),
 				},
 				dnsmessage.PTRResource{
 					PTR: name,
@@ -349,70 +1640,537 @@ func (r *MemResolver) processDNSRequest(id uint16, q dnsmessage.Question) []byte
 				return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
 			}
 		}
+	case typeDNSKEY:
+		keys := r.rootDNSKEY()
+		if name != "." || len(keys) == 0 {
+			r.logf("query type DNSKEY for %s not implemented", q.Name)
+			return dnsErrorMessage(id, dnsmessage.RCodeNotImplemented, q)
+		}
+		for _, key := range keys {
+			err = answer.UnknownResource(
+				dnsmessage.ResourceHeader{
+					Name:  q.Name,
+					Class: q.Class,
+					TTL:   r.recordTTL(q),
+				},
+				dnsmessage.UnknownResource{
+					Type: typeDNSKEY,
+					Data: key.pack(),
+				},
+			)
+			if err != nil {
+				return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+			}
+		}
+	case typeNSEC3:
+		if r.LookupNSEC3 == nil {
+			r.logf("query type NSEC3 for %s not implemented", q.Name)
+			return dnsErrorMessage(id, dnsmessage.RCodeNotImplemented, q)
+		}
+		records, err := r.LookupNSEC3(ctx, name)
+		if err != nil {
+			return r.lookupErrorMessage(ctx, id, q, name, err)
+		}
+		for _, nsec3 := range records {
+			data, err := nsec3.pack()
+			if err != nil {
+				return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+			}
+			err = answer.UnknownResource(
+				dnsmessage.ResourceHeader{
+					Name:  q.Name,
+					Class: q.Class,
+					TTL:   r.recordTTL(q),
+				},
+				dnsmessage.UnknownResource{
+					Type: typeNSEC3,
+					Data: data,
+				},
+			)
+			if err != nil {
+				return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+			}
+		}
 	default:
+		if name, ok := obsoleteTypes[q.Type]; ok {
+			r.logf("obsolete query type %s for %s not implemented", name, q.Name)
+		} else {
+			r.logf("query type %v for %s not implemented", q.Type, q.Name)
+		}
 		return dnsErrorMessage(id, dnsmessage.RCodeNotImplemented, q)
 	}
 	buf, err = answer.Finish()
 	if err != nil {
 		return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
 	}
+	if binary.BigEndian.Uint16(buf[6:8]) == 0 && !exists && nameError(q.Type) && !r.nameExists(ctx, q.Type, name) {
+		return dnsErrorMessage(id, dnsmessage.RCodeNameError, q)
+	}
+	return buf
+}
+
+// lookupErrorMessage returns the encoded response for the error of a typed
+// Lookup function. The names not found are NODATA if they have records of
+// other types.
+func (r *MemResolver) lookupErrorMessage(ctx context.Context, id uint16, q dnsmessage.Question, name string, err error) []byte {
+	rcode := lookupErrorRCode(err)
+	if rcode == dnsmessage.RCodeNameError && r.nameExists(ctx, q.Type, name) {
+		rcode = dnsmessage.RCodeSuccess
+	}
+	return dnsErrorMessage(id, rcode, q)
+}
+
+// nameExists returns true if the name has records of a type other than t. It
+// only uses the Lookup functions, never the DefaultResolver, and the address
+// lookups go first.
+func (r *MemResolver) nameExists(ctx context.Context, t dnsmessage.Type, name string) bool {
+	ctx = context.WithValue(ctx, noFallbackKey{}, true)
+	if t != dnsmessage.TypeA {
+		if weighted, ok := r.weightedA(name); ok && len(weighted) > 0 {
+			return true
+		}
+		if ips, err := r.lookupIP(ctx, "ip4", name); err == nil && hasFamily(ips, true) {
+			return true
+		}
+	}
+	if t != dnsmessage.TypeAAAA {
+		if ips, err := r.lookupIP(ctx, "ip6", name); err == nil && hasFamily(ips, false) {
+			return true
+		}
+	}
+	has := map[dnsmessage.Type]func() bool{
+		dnsmessage.TypeCNAME: func() bool {
+			cname, err := r.lookupCNAME(ctx, name)
+			return err == nil && cname != ""
+		},
+		dnsmessage.TypeNS: func() bool {
+			ns, err := r.lookupNS(ctx, name)
+			return err == nil && len(ns) > 0
+		},
+		dnsmessage.TypeMX: func() bool {
+			mx, err := r.lookupMX(ctx, name)
+			return err == nil && len(mx) > 0
+		},
+		dnsmessage.TypeTXT: func() bool {
+			txt, err := r.lookupTXT(ctx, name)
+			return err == nil && len(txt) > 0
+		},
+		dnsmessage.TypeSRV: func() bool {
+			_, srv, err := r.lookupSRV(ctx, "", "", name)
+			return err == nil && len(srv) > 0
+		},
+		dnsmessage.TypePTR: func() bool {
+			ptr, err := r.lookupAddr(ctx, name)
+			return err == nil && len(ptr) > 0
+		},
+		dnsmessage.TypeSOA: func() bool {
+			soa, err := r.lookupSOA(ctx, name)
+			return err == nil && soa != nil
+		},
+	}
+	for _, other := range []dnsmessage.Type{
+		dnsmessage.TypeCNAME, dnsmessage.TypeNS, dnsmessage.TypeMX, dnsmessage.TypeTXT,
+		dnsmessage.TypeSRV, dnsmessage.TypePTR, dnsmessage.TypeSOA,
+	} {
+		if other != t && has[other]() {
+			return true
+		}
+	}
+	return false
+}
+
+// hasFamily returns true if ips contains an IPv4 address, or an IPv6 address
+// if ipv4 is false.
+func hasFamily(ips []net.IP, ipv4 bool) bool {
+	for _, ip := range ips {
+		if (ip.To4() != nil) == ipv4 {
+			return true
+		}
+	}
+	return false
+}
+
+// nameError returns true if the answer without records of type t may be
+// NXDOMAIN, that is the case for the types answered by the Lookup functions.
+func nameError(t dnsmessage.Type) bool {
+	switch t {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeNS, dnsmessage.TypeMX, dnsmessage.TypeTXT, dnsmessage.TypeSRV,
+		dnsmessage.TypePTR, dnsmessage.TypeSOA, typeNSEC3:
+		return true
+	}
+	return false
+}
+
+// sectionsMessage returns the encoded response with the RCODE and the records
+// of each section.
+func (r *MemResolver) sectionsMessage(id uint16, q dnsmessage.Question, rcode dnsmessage.RCode, answers, authorities, additionals []dnsmessage.Resource) []byte {
+	b := dnsmessage.NewBuilder(nil,
+		dnsmessage.Header{
+			ID:            id,
+			Response:      true,
+			Authoritative: true,
+			RCode:         rcode,
+		})
+	if !r.DisableCompression[q.Type] {
+		b.EnableCompression()
+	}
+	if err := b.StartQuestions(); err != nil {
+		return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+	}
+	if !r.omitQuestion(q.Name.String()) {
+		if err := b.Question(q); err != nil {
+			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+		}
+	}
+	sections := []struct {
+		start     func() error
+		resources []dnsmessage.Resource
+	}{
+		{b.StartAnswers, answers},
+		{b.StartAuthorities, authorities},
+		{b.StartAdditionals, additionals},
+	}
+	for i, section := range sections {
+		if err := section.start(); err != nil {
+			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+		}
+		// the single answer only applies to the answer section
+		resources, ok := r.rrsetResources(section.resources, i == 0 && r.SingleAnswer)
+		if !ok {
+			return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+		}
+		for _, rr := range resources {
+			switch {
+			case rr.Header.Type == dnsmessage.TypeOPT:
+				// the TTL of the OPT pseudo-record contains flags
+			case r.TTLFunc != nil:
+				rr.Header.TTL = r.TTLFunc(dnsmessage.Question{Name: rr.Header.Name, Type: rr.Header.Type, Class: rr.Header.Class})
+			default:
+				rr.Header.TTL = r.clampTTL(rr.Header.TTL)
+			}
+			if err := addResource(&b, rr); err != nil {
+				r.logf("can not add resource %v: %v", rr.Header, err)
+				return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+			}
+		}
+	}
+	buf, err := b.Finish()
+	if err != nil {
+		return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+	}
 	return buf
 }
+
+// rrsetResources returns the resources grouped by RRset, the records of each
+// RRset handled as the ones returned by the typed Lookup functions. If single
+// is set only one random record of the A RRsets is returned. It returns false
+// if the resources must not be answered.
+func (r *MemResolver) rrsetResources(resources []dnsmessage.Resource, single bool) ([]dnsmessage.Resource, bool) {
+	type rrsetKey struct {
+		name string
+		t    dnsmessage.Type
+	}
+	var keys []rrsetKey
+	rrsets := map[rrsetKey][]dnsmessage.Resource{}
+	var out []dnsmessage.Resource
+	for _, rr := range resources {
+		if rr.Header.Type == dnsmessage.TypeOPT || rr.Body == nil {
+			out = append(out, rr)
+			continue
+		}
+		k := rrsetKey{canonicalName(rr.Header.Name.String()), rr.Header.Type}
+		if _, ok := rrsets[k]; !ok {
+			keys = append(keys, k)
+		}
+		rrsets[k] = append(rrsets[k], rr)
+	}
+	for _, k := range keys {
+		rrset := rrsets[k]
+		order, ok := r.order(len(rrset), func(i int) string {
+			return strings.ToLower(rrset[i].Body.GoString())
+		})
+		if !ok {
+			return nil, false
+		}
+		if single && k.t == dnsmessage.TypeA && len(order) > 1 {
+			order = []int{order[r.intn(len(order))]}
+		}
+		for _, i := range order {
+			out = append(out, rrset[i])
+		}
+	}
+	return out, true
+}
+
+// addResource adds the resource to the current section of the builder.
+func addResource(b *dnsmessage.Builder, rr dnsmessage.Resource) error {
+	switch body := rr.Body.(type) {
+	case *dnsmessage.AResource:
+		return b.AResource(rr.Header, *body)
+	case *dnsmessage.AAAAResource:
+		return b.AAAAResource(rr.Header, *body)
+	case *dnsmessage.CNAMEResource:
+		return b.CNAMEResource(rr.Header, *body)
+	case *dnsmessage.MXResource:
+		return b.MXResource(rr.Header, *body)
+	case *dnsmessage.NSResource:
+		return b.NSResource(rr.Header, *body)
+	case *dnsmessage.PTRResource:
+		return b.PTRResource(rr.Header, *body)
+	case *dnsmessage.SOAResource:
+		return b.SOAResource(rr.Header, *body)
+	case *dnsmessage.TXTResource:
+		return b.TXTResource(rr.Header, *body)
+	case *dnsmessage.SRVResource:
+		return b.SRVResource(rr.Header, *body)
+	case *dnsmessage.OPTResource:
+		return b.OPTResource(rr.Header, *body)
+	case *dnsmessage.UnknownResource:
+		return b.UnknownResource(rr.Header, *body)
+	default:
+		return fmt.Errorf("resource body %T not supported", rr.Body)
+	}
+}
+
+// addGlue adds the addresses of the SRV targets to the additional section of
+// the builder, each target once. The targets that can not be resolved are
+// omitted. The addresses are handled as the ones of the A and AAAA answers,
+// it returns an error if they must not be answered.
+func (r *MemResolver) addGlue(ctx context.Context, b *dnsmessage.Builder, class dnsmessage.Class, srvList []*net.SRV) error {
+	if err := b.StartAuthorities(); err != nil {
+		return err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, srv := range srvList {
+		target := canonicalName(srv.Target)
+		if seen[target] || target == "." {
+			continue
+		}
+		seen[target] = true
+		name, err := dnsmessage.NewName(srv.Target)
+		if err != nil {
+			return err
+		}
+		ips, err := r.lookupIP(ctx, "ip", target)
+		if err != nil {
+			r.logf("glue for %s not found: %v", target, err)
+			continue
+		}
+		// the addresses of each family are a RRset, filtered as the answers
+		for _, ipv4 := range []bool{true, false} {
+			var addrs []net.IP
+			for _, ip := range ips {
+				if (ip.To4() != nil) == ipv4 {
+					addrs = append(addrs, ip)
+				}
+			}
+			order, ok := r.order(len(addrs), func(i int) string { return addrs[i].String() })
+			if !ok {
+				return fmt.Errorf("duplicate glue for %s", target)
+			}
+			for _, i := range order {
+				ip := addrs[i]
+				if r.RejectReservedIPs && isReservedIP(ip) {
+					r.logf("reserved address %v for %s rejected", ip, target)
+					return fmt.Errorf("reserved glue address %v for %s", ip, target)
+				}
+				if ipv4 {
+					var a [4]byte
+					copy(a[:], ip.To4())
+					err = b.AResource(
+						dnsmessage.ResourceHeader{Name: name, Class: class, TTL: r.recordTTL(dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: class})},
+						dnsmessage.AResource{A: a},
+					)
+				} else {
+					var aaaa [16]byte
+					copy(aaaa[:], ip.To16())
+					err = b.AAAAResource(
+						dnsmessage.ResourceHeader{Name: name, Class: class, TTL: r.recordTTL(dnsmessage.Question{Name: name, Type: dnsmessage.TypeAAAA, Class: class})},
+						dnsmessage.AAAAResource{AAAA: aaaa},
+					)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// fallback is called before using the DefaultResolver, it returns an error if
+// the fallback is not allowed.
+func (r *MemResolver) fallback(ctx context.Context) error {
+	if noRecursion, _ := ctx.Value(noRecursionKey{}).(bool); noRecursion {
+		return errNoRecursion
+	}
+	if noFallback, _ := ctx.Value(noFallbackKey{}).(bool); noFallback {
+		return errNoFallback
+	}
+	r.mu.Lock()
+	r.fallbackAttempts++
+	r.mu.Unlock()
+	if r.FailOnFallback {
+		return errFallback
+	}
+	if r.OnFallback != nil {
+		q, _ := ctx.Value(questionKey{}).(dnsmessage.Question)
+		r.OnFallback(q)
+	}
+	return nil
+}
+
+// FallbackAttempts returns the number of lookups that used, or tried to use
+// if FailOnFallback is set, the DefaultResolver.
+func (r *MemResolver) FallbackAttempts() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fallbackAttempts
+}
+
 func (r *MemResolver) lookupAddr(ctx context.Context, addr string) (names []string, err error) {
 	if r.LookupAddr != nil {
 		return r.LookupAddr(ctx, addr)
 	}
+	if err := r.fallback(ctx); err != nil {
+		return nil, err
+	}
+	// net.Resolver.LookupAddr receives the address instead of the reverse name
+	if ip, ok := reverseAddr(addr); ok {
+		addr = ip.String()
+	}
 	return net.DefaultResolver.LookupAddr(ctx, addr)
 }
 func (r *MemResolver) lookupCNAME(ctx context.Context, host string) (cname string, err error) {
 	if r.LookupCNAME != nil {
 		return r.LookupCNAME(ctx, host)
 	}
+	if err := r.fallback(ctx); err != nil {
+		return "", err
+	}
 	return net.DefaultResolver.LookupCNAME(ctx, host)
 }
 func (r *MemResolver) lookupHost(ctx context.Context, host string) (addrs []string, err error) {
 	if r.LookupHost != nil {
 		return r.LookupHost(ctx, host)
 	}
+	if err := r.fallback(ctx); err != nil {
+		return nil, err
+	}
 	return net.DefaultResolver.LookupHost(ctx, host)
 }
 func (r *MemResolver) lookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if ips, ok := r.rotatingIPs(host); ok {
+		return ips, nil
+	}
+	if ips, ok := r.appearedIPs(host); ok {
+		return ips, nil
+	}
 	if r.LookupIP != nil {
 		return r.LookupIP(ctx, network, host)
 	}
+	if err := r.fallback(ctx); err != nil {
+		return nil, err
+	}
 	return net.DefaultResolver.LookupIP(ctx, network, host)
 }
 func (r *MemResolver) lookupMX(ctx context.Context, name string) ([]*net.MX, error) {
 	if r.LookupMX != nil {
 		return r.LookupMX(ctx, name)
 	}
+	if err := r.fallback(ctx); err != nil {
+		return nil, err
+	}
 	return net.DefaultResolver.LookupMX(ctx, name)
 }
 func (r *MemResolver) lookupNS(ctx context.Context, name string) ([]*net.NS, error) {
 	if r.LookupNS != nil {
 		return r.LookupNS(ctx, name)
 	}
+	if err := r.fallback(ctx); err != nil {
+		return nil, err
+	}
 	return net.DefaultResolver.LookupNS(ctx, name)
 }
 func (r *MemResolver) lookupPort(ctx context.Context, network, service string) (port int, err error) {
 	if r.LookupPort != nil {
 		return r.LookupPort(ctx, network, service)
 	}
+	if err := r.fallback(ctx); err != nil {
+		return 0, err
+	}
 	return net.DefaultResolver.LookupPort(ctx, network, service)
 }
+func (r *MemResolver) lookupSOA(ctx context.Context, name string) (*SOA, error) {
+	if r.LookupSOA != nil {
+		return r.LookupSOA(ctx, name)
+	}
+	return nil, errNotImplemented
+}
 func (r *MemResolver) lookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error) {
 	if r.LookupSRV != nil {
 		return r.LookupSRV(ctx, service, proto, name)
 	}
+	if err := r.fallback(ctx); err != nil {
+		return "", nil, err
+	}
 	return net.DefaultResolver.LookupSRV(ctx, service, proto, name)
 }
 func (r *MemResolver) lookupTXT(ctx context.Context, name string) ([]string, error) {
 	if r.LookupTXT != nil {
 		return r.LookupTXT(ctx, name)
 	}
+	if err := r.fallback(ctx); err != nil {
+		return nil, err
+	}
 	return net.DefaultResolver.LookupTXT(ctx, name)
 }
 
+// SOA represents a start of authority record, as per RFC 1035 section 3.3.13.
+type SOA struct {
+	// NS is the primary name server of the zone.
+	NS string
+	// Mbox is the mailbox of the person responsible for the zone.
+	Mbox    string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	// MinTTL is the TTL of the negative responses, as per RFC 2308.
+	MinTTL uint32
+}
+
+// NullMX returns the null MX record of RFC 7505, used by the LookupMX function
+// of the domains that do not accept email.
+func NullMX() []*net.MX {
+	return []*net.MX{{Host: ".", Pref: 0}}
+}
+
+// Resolve answers a question for name and type t, using the same logic than the
+// DNS queries, and returns the records of the answer section and the RCODE.
+func (r *MemResolver) Resolve(ctx context.Context, name string, t dnsmessage.Type) ([]dnsmessage.Resource, dnsmessage.RCode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, dnsmessage.RCodeSuccess, err
+	}
+	n, err := dnsmessage.NewName(canonicalName(name))
+	if err != nil {
+		return nil, dnsmessage.RCodeSuccess, err
+	}
+	q := dnsmessage.Question{
+		Name:  n,
+		Type:  t,
+		Class: dnsmessage.ClassINET,
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(r.processDNSRequestContext(ctx, 0, q)); err != nil {
+		return nil, dnsmessage.RCodeSuccess, err
+	}
+	return msg.Answers, msg.RCode, nil
+}
+
 // Dial creates an in memory connection to the in-memory resolver.
 // Used to create a custom net.Resolver
 func (r *MemResolver) Dial(ctx context.Context, network, address string) (net.Conn, error) {
@@ -5,16 +5,69 @@ package resolver
 
 // https://github.com/golang/go/blob/master/src/net/lookup_test.go
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
 	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func hasSuffixFold(s, suffix string) bool {
 	return strings.HasSuffix(strings.ToLower(s), strings.ToLower(suffix))
 }
+
+// exchange sends a query to the resolver packet handler and returns the
+// parsed response.
+func exchange(t *testing.T, r *MemResolver, name string, qtype dnsmessage.Type) dnsmessage.Message {
+	t.Helper()
+	msg, _ := exchangeMsg(t, r, newQuery(name, qtype), true)
+	return msg
+}
+
+// newQuery returns a query message for name and type.
+func newQuery(name string, qtype dnsmessage.Type) dnsmessage.Message {
+	return dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+}
+
+// exchangeMsg sends the query to the resolver UDP or TCP handler and returns
+// the parsed response and its length, without the TCP length prefix.
+func exchangeMsg(t *testing.T, r *MemResolver, query dnsmessage.Message, udp bool) (dnsmessage.Message, int) {
+	t.Helper()
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answer []byte
+	if udp {
+		answer = r.dnsPacketRoundTrip(b)
+	} else {
+		answer = r.dnsStreamRoundTrip(append([]byte{byte(len(b) >> 8), byte(len(b))}, b...))[2:]
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(answer); err != nil {
+		t.Fatal(err)
+	}
+	return msg, len(answer)
+}
 func TestLookupNS(t *testing.T) {
 	t.Parallel()
 	var lookupGmailNSTests = []struct {
@@ -159,6 +212,31 @@ func TestLookupLongTXT(t *testing.T) {
 		t.Fatalf("LookupTXT golang.rsc.io incorrect\nhave %q\nwant %q", txts, sb.String())
 	}
 }
+func TestLookupAddrReverseName(t *testing.T) {
+	t.Parallel()
+	var reverseNameTests = []struct {
+		ip, name string
+	}{
+		{"192.0.2.1", "1.2.0.192.in-addr.arpa."},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+	}
+	for _, tt := range reverseNameTests {
+		var got string
+		f := &MemResolver{
+			LookupAddr: func(ctx context.Context, addr string) (names []string, err error) {
+				got = addr
+				return []string{"host.example.com."}, nil
+			},
+		}
+		if _, err := NewMemoryResolver(f).LookupAddr(context.Background(), tt.ip); err != nil {
+			t.Fatal(err)
+		}
+		// LookupAddr receives the question name, not the address
+		if got != tt.name {
+			t.Errorf("%s: LookupAddr got %q; want %q", tt.ip, got, tt.name)
+		}
+	}
+}
 func TestLookupIP(t *testing.T) {
 	t.Parallel()
 	var lookupGoogleIPTests = []struct {
@@ -291,3 +369,2381 @@ func TestLookupMX(t *testing.T) {
 		}
 	}
 }
+func TestWeightedA(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		WeightedA: map[string][]WeightedIP{
+			"weighted.example.com": {
+				{IP: net.ParseIP("10.0.0.1"), Weight: 1},
+				{IP: net.ParseIP("10.0.0.2"), Weight: 3},
+			},
+		},
+		SingleAnswer: true,
+		Rand:         rand.NewSource(1),
+	}
+	queries := 4000
+	count := map[string]int{}
+	for i := 0; i < queries; i++ {
+		msg := exchange(t, f, "weighted.example.com.", dnsmessage.TypeA)
+		if len(msg.Answers) != 1 {
+			t.Fatalf("got %d answers; want 1", len(msg.Answers))
+		}
+		a := msg.Answers[0].Body.(*dnsmessage.AResource).A
+		count[net.IP(a[:]).String()]++
+	}
+	want := map[string]int{"10.0.0.1": queries / 4, "10.0.0.2": queries * 3 / 4}
+	for ip, n := range want {
+		if count[ip] < n*9/10 || count[ip] > n*11/10 {
+			t.Errorf("got %d answers for %s; want %d +/- 10%%", count[ip], ip, n)
+		}
+	}
+}
+func TestOnAmplification(t *testing.T) {
+	t.Parallel()
+	var queryLen, responseLen int
+	f := &MemResolver{
+		LookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			return []string{strings.Repeat("a", 255), strings.Repeat("b", 255), strings.Repeat("c", 255)}, nil
+		},
+		OnAmplification: func(q, r int) {
+			queryLen, responseLen = q, r
+		},
+	}
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("amplification.example.com."),
+			Type:  dnsmessage.TypeTXT,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// use TCP so the answer is not truncated
+	b = append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)
+	answer := f.dnsStreamRoundTrip(b)
+	if queryLen != len(b)-2 {
+		t.Errorf("got query length %d; want %d", queryLen, len(b)-2)
+	}
+	if responseLen != len(answer)-2 {
+		t.Errorf("got response length %d; want %d", responseLen, len(answer)-2)
+	}
+	if ratio := responseLen / queryLen; ratio < 10 {
+		t.Errorf("got amplification factor %d; want at least 10", ratio)
+	}
+}
+func TestRFC6761(t *testing.T) {
+	t.Parallel()
+	var lookupLocalhostTests = []struct {
+		name  string
+		qtype dnsmessage.Type
+		want  string
+	}{
+		{"localhost.", dnsmessage.TypeA, "127.0.0.1"},
+		{"LocalHost.", dnsmessage.TypeA, "127.0.0.1"},
+		{"test.localhost.", dnsmessage.TypeA, "127.0.0.1"},
+		{"localhost.", dnsmessage.TypeAAAA, "::1"},
+		{"1.0.0.127.in-addr.arpa.", dnsmessage.TypePTR, "localhost."},
+		{localhostReverse6, dnsmessage.TypePTR, "localhost."},
+		{"localhost.", dnsmessage.TypeMX, ""},
+	}
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			return nil, fmt.Errorf("unexpected lookup for %s", host)
+		},
+		LookupAddr: func(ctx context.Context, addr string) (names []string, err error) {
+			return nil, fmt.Errorf("unexpected lookup for %s", addr)
+		},
+		LookupMX: func(ctx context.Context, name string) ([]*net.MX, error) {
+			return nil, fmt.Errorf("unexpected lookup for %s", name)
+		},
+		RFC6761: true,
+	}
+	for _, tt := range lookupLocalhostTests {
+		msg := exchange(t, f, tt.name, tt.qtype)
+		if msg.RCode != dnsmessage.RCodeSuccess {
+			t.Errorf("%s %v: got %v; want %v", tt.name, tt.qtype, msg.RCode, dnsmessage.RCodeSuccess)
+			continue
+		}
+		if tt.want == "" {
+			if len(msg.Answers) != 0 {
+				t.Errorf("%s %v: got %d answers; want none", tt.name, tt.qtype, len(msg.Answers))
+			}
+			continue
+		}
+		if len(msg.Answers) != 1 {
+			t.Errorf("%s %v: got %d answers; want 1", tt.name, tt.qtype, len(msg.Answers))
+			continue
+		}
+		var got string
+		switch body := msg.Answers[0].Body.(type) {
+		case *dnsmessage.AResource:
+			got = net.IP(body.A[:]).String()
+		case *dnsmessage.AAAAResource:
+			got = net.IP(body.AAAA[:]).String()
+		case *dnsmessage.PTRResource:
+			got = body.PTR.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s %v: got %s; want %s", tt.name, tt.qtype, got, tt.want)
+		}
+		if ttl := msg.Answers[0].Header.TTL; ttl != 300 {
+			t.Errorf("%s %v: got TTL %d; want 300", tt.name, tt.qtype, ttl)
+		}
+	}
+	// the answers use the configured TTLs
+	f.TTL = 60
+	f.TTLByType = map[dnsmessage.Type]uint32{dnsmessage.TypeAAAA: 30}
+	for qtype, want := range map[dnsmessage.Type]uint32{dnsmessage.TypeA: 60, dnsmessage.TypeAAAA: 30} {
+		msg := exchange(t, f, "localhost.", qtype)
+		if len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != want {
+			t.Errorf("%v: got %v; want TTL %d", qtype, msg.Answers, want)
+		}
+	}
+	f.TTLFunc = func(q dnsmessage.Question) uint32 { return 5 }
+	if msg := exchange(t, f, "localhost.", dnsmessage.TypeA); len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != 5 {
+		t.Errorf("got %v; want TTL 5", msg.Answers)
+	}
+}
+func TestErrorMessage(t *testing.T) {
+	t.Parallel()
+	lookupIPError := func(err error) *MemResolver {
+		return &MemResolver{
+			LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+				return nil, err
+			},
+		}
+	}
+	lookupRCode := func(rcode dnsmessage.RCode) *MemResolver {
+		return &MemResolver{
+			Lookup: func(ctx context.Context, q dnsmessage.Question) ([]dnsmessage.Resource, dnsmessage.RCode, error) {
+				return nil, rcode, nil
+			},
+		}
+	}
+	var lookupErrorTests = []struct {
+		resolver   *MemResolver
+		rcode      dnsmessage.RCode
+		err        string
+		isNotFound bool
+		isTemp     bool
+	}{
+		{lookupRCode(dnsmessage.RCodeFormatError), dnsmessage.RCodeFormatError, "server misbehaving", false, false},
+		{lookupIPError(fmt.Errorf("lookup failed")), dnsmessage.RCodeServerFailure, "server misbehaving", false, true},
+		{lookupIPError(&net.DNSError{Err: "no such host", IsNotFound: true}), dnsmessage.RCodeNameError, "no such host", true, false},
+		{lookupRCode(dnsmessage.RCodeNotImplemented), dnsmessage.RCodeNotImplemented, "server misbehaving", false, false},
+		{lookupRCode(dnsmessage.RCodeRefused), dnsmessage.RCodeRefused, "server misbehaving", false, false},
+	}
+	for _, tt := range lookupErrorTests {
+		if msg := exchange(t, tt.resolver, "error.example.com.", dnsmessage.TypeA); msg.RCode != tt.rcode {
+			t.Errorf("%v: got RCODE %v", tt.rcode, msg.RCode)
+		}
+		_, err := NewMemoryResolver(tt.resolver).LookupIP(context.Background(), "ip4", "error.example.com")
+		dnsErr, ok := err.(*net.DNSError)
+		if !ok {
+			t.Errorf("%v: got error %v; want a *net.DNSError", tt.rcode, err)
+			continue
+		}
+		if dnsErr.Err != tt.err || dnsErr.IsNotFound != tt.isNotFound || dnsErr.IsTemporary != tt.isTemp {
+			t.Errorf("%v: got %q IsNotFound %v IsTemporary %v; want %q IsNotFound %v IsTemporary %v",
+				tt.rcode, dnsErr.Err, dnsErr.IsNotFound, dnsErr.IsTemporary, tt.err, tt.isNotFound, tt.isTemp)
+		}
+	}
+}
+func TestLookupError(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			return nil, fmt.Errorf("error")
+		},
+	}
+	r := NewMemoryResolver(f)
+	_, err := r.LookupIP(context.Background(), "ip4", "error.example.com")
+	dnsErr, ok := err.(*net.DNSError)
+	if !ok {
+		t.Fatalf("got error %v; want a *net.DNSError", err)
+	}
+	if !dnsErr.IsTemporary || dnsErr.IsNotFound {
+		t.Errorf("got IsTemporary %v IsNotFound %v; want a temporary error", dnsErr.IsTemporary, dnsErr.IsNotFound)
+	}
+}
+func TestMalformedQuery(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{}
+	var malformedTests = [][]byte{
+		{0, 1, 2},
+		// header with 2 questions and no question section
+		{0, 1, 1, 0, 0, 2, 0, 0, 0, 0, 0, 0},
+		// header without questions
+		{0, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	}
+	for _, b := range malformedTests {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(f.dnsPacketRoundTrip(b)); err != nil {
+			t.Fatal(err)
+		}
+		if msg.RCode != dnsmessage.RCodeFormatError {
+			t.Errorf("got %v; want %v", msg.RCode, dnsmessage.RCodeFormatError)
+		}
+		answer := f.dnsStreamRoundTrip(append([]byte{0, byte(len(b))}, b...))
+		if err := msg.Unpack(answer[2:]); err != nil {
+			t.Fatal(err)
+		}
+		if msg.RCode != dnsmessage.RCodeFormatError {
+			t.Errorf("got %v; want %v", msg.RCode, dnsmessage.RCodeFormatError)
+		}
+	}
+}
+func TestTTLByType(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, nil
+		},
+		LookupNS: func(ctx context.Context, name string) ([]*net.NS, error) {
+			return []*net.NS{{Host: "ns1.example.com."}}, nil
+		},
+		LookupMX: func(ctx context.Context, name string) ([]*net.MX, error) {
+			return []*net.MX{{Host: "mx.example.com.", Pref: 10}}, nil
+		},
+		TTL: 3600,
+		TTLByType: map[dnsmessage.Type]uint32{
+			dnsmessage.TypeA:  60,
+			dnsmessage.TypeNS: 86400,
+		},
+	}
+	var ttlTests = []struct {
+		qtype dnsmessage.Type
+		ttl   uint32
+	}{
+		{dnsmessage.TypeA, 60},
+		{dnsmessage.TypeNS, 86400},
+		{dnsmessage.TypeMX, 3600},
+	}
+	for _, tt := range ttlTests {
+		msg := exchange(t, f, "ttl.example.com.", tt.qtype)
+		if len(msg.Answers) != 1 {
+			t.Fatalf("%v: got %d answers; want 1", tt.qtype, len(msg.Answers))
+		}
+		if msg.Answers[0].Header.TTL != tt.ttl {
+			t.Errorf("%v: got TTL %d; want %d", tt.qtype, msg.Answers[0].Header.TTL, tt.ttl)
+		}
+	}
+	f.TTL = 0
+	msg := exchange(t, f, "ttl.example.com.", dnsmessage.TypeAAAA)
+	if len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != 300 {
+		t.Errorf("got %v; want one answer with TTL 300", msg.Answers)
+	}
+}
+func TestFailOnFallback(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		FailOnFallback: true,
+	}
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypePTR} {
+		msg := exchange(t, f, "fallback.example.com.", qtype)
+		if msg.RCode != dnsmessage.RCodeServerFailure {
+			t.Errorf("%v: got %v; want %v", qtype, msg.RCode, dnsmessage.RCodeServerFailure)
+		}
+	}
+	if n := f.FallbackAttempts(); n != 2 {
+		t.Errorf("got %d fallback attempts; want 2", n)
+	}
+}
+func TestOmitQuestion(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP:     lookupIPs("192.0.2.1"),
+		OmitQuestion: map[string]bool{"buggy.example.com": true},
+	}
+	msg := exchange(t, f, "buggy.example.com.", dnsmessage.TypeA)
+	if len(msg.Questions) != 0 {
+		t.Errorf("got %d questions; want 0", len(msg.Questions))
+	}
+	if len(msg.Answers) != 1 {
+		t.Errorf("got %d answers; want 1", len(msg.Answers))
+	}
+	msg = exchange(t, f, "good.example.com.", dnsmessage.TypeA)
+	if len(msg.Questions) != 1 {
+		t.Errorf("got %d questions; want 1", len(msg.Questions))
+	}
+}
+func TestOpCode(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			t.Errorf("unexpected lookup for %s", host)
+			return nil, nil
+		},
+	}
+	// NOTIFY and UPDATE
+	for _, opCode := range []dnsmessage.OpCode{4, 5} {
+		query := newQuery("opcode.example.com.", dnsmessage.TypeSOA)
+		query.OpCode = opCode
+		for _, udp := range []bool{true, false} {
+			msg, _ := exchangeMsg(t, f, query, udp)
+			if msg.RCode != dnsmessage.RCodeNotImplemented {
+				t.Errorf("opcode %d: got %v; want %v", opCode, msg.RCode, dnsmessage.RCodeNotImplemented)
+			}
+			if msg.OpCode != opCode {
+				t.Errorf("got opcode %d; want %d", msg.OpCode, opCode)
+			}
+		}
+	}
+}
+func TestCasePreserving(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			if host != "mixedcase.example.com." {
+				return nil, fmt.Errorf("unexpected host %s", host)
+			}
+			return []net.IP{net.ParseIP("192.0.2.1")}, nil
+		},
+	}
+	name := "MiXeDcAsE.eXaMpLe.CoM."
+	msg := exchange(t, f, name, dnsmessage.TypeA)
+	if msg.RCode != dnsmessage.RCodeSuccess {
+		t.Fatalf("got %v; want %v", msg.RCode, dnsmessage.RCodeSuccess)
+	}
+	if got := msg.Questions[0].Name.String(); got != name {
+		t.Errorf("got question %s; want %s", got, name)
+	}
+	if len(msg.Answers) != 1 {
+		t.Fatalf("got %d answers; want 1", len(msg.Answers))
+	}
+	if got := msg.Answers[0].Header.Name.String(); got != name {
+		t.Errorf("got answer %s; want %s", got, name)
+	}
+}
+
+// suffixRouter routes the questions for the names with the suffix.
+type suffixRouter struct {
+	suffix  string
+	handler Handler
+}
+
+func (s suffixRouter) Route(q dnsmessage.Question) (Handler, bool) {
+	if strings.HasSuffix(q.Name.String(), s.suffix) {
+		return s.handler, true
+	}
+	return nil, false
+}
+
+func TestRouter(t *testing.T) {
+	t.Parallel()
+	special := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.100"),
+	}
+	f := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.1"),
+		Router: suffixRouter{
+			suffix:  ".special.",
+			handler: special,
+		},
+	}
+	var routerTests = []struct {
+		name string
+		want string
+	}{
+		{"host.special.", "192.0.2.100"},
+		{"a.b.special.", "192.0.2.100"},
+		{"host.example.com.", "192.0.2.1"},
+	}
+	for _, tt := range routerTests {
+		msg := exchange(t, f, tt.name, dnsmessage.TypeA)
+		if len(msg.Answers) != 1 {
+			t.Fatalf("%s: got %d answers; want 1", tt.name, len(msg.Answers))
+		}
+		a := msg.Answers[0].Body.(*dnsmessage.AResource).A
+		if got := net.IP(a[:]).String(); got != tt.want {
+			t.Errorf("%s: got %s; want %s", tt.name, got, tt.want)
+		}
+	}
+	// the Handler receives the context of the query
+	f.CallbackTimeout = time.Minute
+	f.Router = suffixRouter{
+		suffix: ".special.",
+		handler: HandlerFunc(func(ctx context.Context, id uint16, q dnsmessage.Question) []byte {
+			if _, ok := ctx.Deadline(); !ok {
+				return dnsErrorMessage(id, dnsmessage.RCodeServerFailure, q)
+			}
+			return special.Answer(ctx, id, q)
+		}),
+	}
+	if msg := exchange(t, f, "host.special.", dnsmessage.TypeA); msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+		t.Errorf("got %v with %d answers; want the answer of the Handler", msg.RCode, len(msg.Answers))
+	}
+}
+
+func TestWithRandSource(t *testing.T) {
+	t.Parallel()
+	lookupIP := func(ctx context.Context, network, host string) ([]net.IP, error) {
+		return []net.IP{
+			net.ParseIP("192.0.2.1"),
+			net.ParseIP("192.0.2.2"),
+			net.ParseIP("192.0.2.3"),
+			net.ParseIP("192.0.2.4"),
+		}, nil
+	}
+	run := func() []string {
+		f := (&MemResolver{
+			LookupIP:     lookupIP,
+			SingleAnswer: true,
+		}).WithRandSource(rand.NewSource(42))
+		var got []string
+		for i := 0; i < 20; i++ {
+			msg := exchange(t, f, "random.example.com.", dnsmessage.TypeA)
+			if len(msg.Answers) != 1 {
+				t.Fatalf("got %d answers; want 1", len(msg.Answers))
+			}
+			a := msg.Answers[0].Body.(*dnsmessage.AResource).A
+			got = append(got, net.IP(a[:]).String())
+		}
+		return got
+	}
+	first, second := run(), run()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("got different answers with the same seed:\n%v\n%v", first, second)
+		}
+	}
+}
+func TestResolve(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			if host != "resolve.example.com." {
+				return nil, fmt.Errorf("unexpected host %s", host)
+			}
+			return []net.IP{net.ParseIP("192.0.2.1")}, nil
+		},
+	}
+	answers, rcode, err := f.Resolve(context.Background(), "resolve.example.com", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcode != dnsmessage.RCodeSuccess {
+		t.Fatalf("got %v; want %v", rcode, dnsmessage.RCodeSuccess)
+	}
+	if len(answers) != 1 {
+		t.Fatalf("got %d answers; want 1", len(answers))
+	}
+	a, ok := answers[0].Body.(*dnsmessage.AResource)
+	if !ok || a.A != [4]byte{192, 0, 2, 1} {
+		t.Errorf("got %v; want A 192.0.2.1", answers[0].Body)
+	}
+	_, rcode, err = f.Resolve(context.Background(), "other.example.com", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcode != dnsmessage.RCodeServerFailure {
+		t.Errorf("got %v; want %v", rcode, dnsmessage.RCodeServerFailure)
+	}
+}
+
+// fakeClock is a clock that only moves when it is advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// After advances the clock by d and returns a channel with the new time.
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.Advance(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch
+}
+
+func TestOutageSchedule(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{now: time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)}
+	f := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.1"),
+		Now:      clock.Now,
+		OutageSchedule: []Outage{
+			{Start: 5 * time.Second, End: 10 * time.Second, RCode: dnsmessage.RCodeServerFailure},
+		},
+	}
+	var outageTests = []struct {
+		advance time.Duration
+		rcode   dnsmessage.RCode
+	}{
+		{0, dnsmessage.RCodeSuccess},
+		{4 * time.Second, dnsmessage.RCodeSuccess},
+		{1 * time.Second, dnsmessage.RCodeServerFailure},
+		{4 * time.Second, dnsmessage.RCodeServerFailure},
+		{1 * time.Second, dnsmessage.RCodeSuccess},
+		{time.Minute, dnsmessage.RCodeSuccess},
+	}
+	for i, tt := range outageTests {
+		clock.Advance(tt.advance)
+		msg := exchange(t, f, "outage.example.com.", dnsmessage.TypeA)
+		if msg.RCode != tt.rcode {
+			t.Errorf("query %d: got %v; want %v", i, msg.RCode, tt.rcode)
+		}
+	}
+}
+func TestNullMX(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupMX: func(ctx context.Context, name string) ([]*net.MX, error) {
+			return NullMX(), nil
+		},
+	}
+	msg := exchange(t, f, "nomail.example.com.", dnsmessage.TypeMX)
+	if len(msg.Answers) != 1 {
+		t.Fatalf("got %d answers; want 1", len(msg.Answers))
+	}
+	mx := msg.Answers[0].Body.(*dnsmessage.MXResource)
+	if mx.Pref != 0 || mx.MX.String() != "." {
+		t.Errorf("got MX %d %s; want 0 .", mx.Pref, mx.MX)
+	}
+	r := NewMemoryResolver(f)
+	mxs, err := r.LookupMX(context.Background(), "nomail.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mxs) != 1 || mxs[0].Pref != 0 || mxs[0].Host != "." {
+		t.Errorf("got %v; want the null MX", mxs)
+	}
+}
+func TestDisableCompression(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupMX: func(ctx context.Context, name string) ([]*net.MX, error) {
+			return []*net.MX{{Host: "mail.example.com.", Pref: 10}}, nil
+		},
+		LookupNS: func(ctx context.Context, name string) ([]*net.NS, error) {
+			return []*net.NS{{Host: "ns.example.com."}}, nil
+		},
+		DisableCompression: map[dnsmessage.Type]bool{dnsmessage.TypeMX: true},
+	}
+	wire := func(qtype dnsmessage.Type) []byte {
+		query := newQuery("example.com.", qtype)
+		b, err := query.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f.dnsPacketRoundTrip(b)
+	}
+	// pointer to the question name, right after the 12 bytes header
+	pointer := []byte{0xC0, 12}
+	if bytes.Contains(wire(dnsmessage.TypeMX), pointer) {
+		t.Errorf("got compressed names in the MX response")
+	}
+	if !bytes.Contains(wire(dnsmessage.TypeNS), pointer) {
+		t.Errorf("got uncompressed names in the NS response")
+	}
+}
+func TestOnFallback(t *testing.T) {
+	t.Parallel()
+	var got []dnsmessage.Question
+	f := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.1"),
+		OnFallback: func(q dnsmessage.Question) {
+			got = append(got, q)
+		},
+	}
+	exchange(t, f, "configured.example.com.", dnsmessage.TypeA)
+	if len(got) != 0 {
+		t.Fatalf("got fallback for %v; want none", got)
+	}
+	// the DefaultResolver can not be used in the tests, so it fails after
+	// calling the hook
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q := dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("fallback.example.com."),
+		Type:  dnsmessage.TypeMX,
+		Class: dnsmessage.ClassINET,
+	}
+	f.processDNSRequestContext(ctx, 1, q)
+	if len(got) != 1 || got[0] != q {
+		t.Errorf("got fallback for %v; want %v", got, q)
+	}
+}
+func TestHonorRecursionDesired(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP:              lookupIPs("192.0.2.1"),
+		HonorRecursionDesired: true,
+		FailOnFallback:        true,
+	}
+	var recursionTests = []struct {
+		rd       bool
+		qtype    dnsmessage.Type
+		rcode    dnsmessage.RCode
+		attempts uint64
+	}{
+		// authoritative data is always answered
+		{false, dnsmessage.TypeA, dnsmessage.RCodeSuccess, 0},
+		{false, dnsmessage.TypeMX, dnsmessage.RCodeRefused, 0},
+		// FailOnFallback makes the fallback fail
+		{true, dnsmessage.TypeMX, dnsmessage.RCodeServerFailure, 1},
+	}
+	for _, tt := range recursionTests {
+		query := newQuery("recursion.example.com.", tt.qtype)
+		query.RecursionDesired = tt.rd
+		msg, _ := exchangeMsg(t, f, query, true)
+		if msg.RCode != tt.rcode {
+			t.Errorf("RD %v %v: got %v; want %v", tt.rd, tt.qtype, msg.RCode, tt.rcode)
+		}
+		if n := f.FallbackAttempts(); n != tt.attempts {
+			t.Errorf("RD %v %v: got %d fallback attempts; want %d", tt.rd, tt.qtype, n, tt.attempts)
+		}
+	}
+}
+func TestPostProcess(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.1"),
+	}
+	query := newQuery("postprocess.example.com.", dnsmessage.TypeA)
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := f.dnsPacketRoundTrip(b)
+	f.PostProcess = func(response []byte) []byte {
+		return append(response, 0xFF)
+	}
+	if got := f.dnsPacketRoundTrip(b); !bytes.Equal(got, append(want, 0xFF)) {
+		t.Errorf("got UDP response %v; want %v", got, append(want, 0xFF))
+	}
+	got := f.dnsStreamRoundTrip(append([]byte{byte(len(b) >> 8), byte(len(b))}, b...))
+	if n := int(got[0])<<8 | int(got[1]); n != len(want)+1 {
+		t.Errorf("got TCP length prefix %d; want %d", n, len(want)+1)
+	}
+	if !bytes.Equal(got[2:], append(want, 0xFF)) {
+		t.Errorf("got TCP response %v; want %v", got[2:], append(want, 0xFF))
+	}
+}
+
+// lookupIPs returns a LookupIP function that answers the addresses for all
+// the names.
+func lookupIPs(addrs ...string) func(ctx context.Context, network, host string) ([]net.IP, error) {
+	return func(ctx context.Context, network, host string) ([]net.IP, error) {
+		ips := make([]net.IP, len(addrs))
+		for i, addr := range addrs {
+			ips[i] = net.ParseIP(addr)
+		}
+		return ips, nil
+	}
+}
+
+// resolverWithIP returns a MemResolver that answers the address ip for all the
+// names.
+func resolverWithIP(ip string) *MemResolver {
+	return &MemResolver{LookupIP: lookupIPs(ip)}
+}
+
+// manyIPs returns n different IPv4 addresses.
+func manyIPs(n int) []net.IP {
+	ips := make([]net.IP, n)
+	for i := range ips {
+		ips[i] = net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+	}
+	return ips
+}
+
+func TestLargeRRset(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			if host == "huge.example.com." {
+				return manyIPs(5000), nil
+			}
+			return manyIPs(1000), nil
+		},
+	}
+	// UDP is truncated and the Go resolver retries over TCP
+	msg := exchange(t, f, "large.example.com.", dnsmessage.TypeA)
+	if !msg.Truncated {
+		t.Errorf("got UDP response not truncated")
+	}
+	r := NewMemoryResolver(f)
+	ips, err := r.LookupIP(context.Background(), "ip4", "large.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1000 {
+		t.Errorf("got %d records; want 1000", len(ips))
+	}
+	// 5000 records do not fit in a TCP message
+	msg, _ = exchangeMsg(t, f, newQuery("huge.example.com.", dnsmessage.TypeA), false)
+	if !msg.Truncated {
+		t.Errorf("got TCP response not truncated")
+	}
+}
+
+func BenchmarkLargeRRset(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		ips := manyIPs(n)
+		f := &MemResolver{
+			LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+				return ips, nil
+			},
+		}
+		q := dnsmessage.Question{
+			Name:  dnsmessage.MustNewName("large.example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				f.processDNSRequest(1, q)
+			}
+		})
+	}
+}
+func TestReadyAfter(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{now: time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)}
+	f := &MemResolver{
+		LookupIP:   lookupIPs("192.0.2.1"),
+		Now:        clock.Now,
+		ReadyAfter: 30 * time.Second,
+	}
+	var readyTests = []struct {
+		advance time.Duration
+		rcode   dnsmessage.RCode
+	}{
+		{0, dnsmessage.RCodeServerFailure},
+		{29 * time.Second, dnsmessage.RCodeServerFailure},
+		{1 * time.Second, dnsmessage.RCodeSuccess},
+		{time.Hour, dnsmessage.RCodeSuccess},
+	}
+	for i, tt := range readyTests {
+		clock.Advance(tt.advance)
+		msg := exchange(t, f, "warmup.example.com.", dnsmessage.TypeA)
+		if msg.RCode != tt.rcode {
+			t.Errorf("query %d: got %v; want %v", i, msg.RCode, tt.rcode)
+		}
+		if tt.rcode == dnsmessage.RCodeSuccess && len(msg.Answers) != 1 {
+			t.Errorf("query %d: got %d answers; want 1", i, len(msg.Answers))
+		}
+	}
+}
+func TestObsoleteType(t *testing.T) {
+	t.Parallel()
+	var logs []string
+	f := &MemResolver{
+		Logf: func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}
+	// A6
+	msg := exchange(t, f, "obsolete.example.com.", dnsmessage.Type(38))
+	if msg.RCode != dnsmessage.RCodeNotImplemented {
+		t.Errorf("got %v; want %v", msg.RCode, dnsmessage.RCodeNotImplemented)
+	}
+	if len(logs) != 1 || !strings.Contains(logs[0], "obsolete query type A6") {
+		t.Errorf("got logs %q; want a log for the obsolete A6 type", logs)
+	}
+}
+func TestColdCacheLatency(t *testing.T) {
+	t.Parallel()
+	latency := 200 * time.Millisecond
+	clock := &fakeClock{now: time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)}
+	f := &MemResolver{
+		LookupIP:         lookupIPs("192.0.2.1"),
+		ColdCacheLatency: latency,
+		Now:              clock.Now,
+		After:            clock.After,
+	}
+	for _, name := range []string{"cold.example.com.", "other.example.com."} {
+		start := clock.Now()
+		exchange(t, f, name, dnsmessage.TypeA)
+		if d := clock.Now().Sub(start); d != latency {
+			t.Errorf("%s: first query waited %v; want %v", name, d, latency)
+		}
+		start = clock.Now()
+		exchange(t, f, name, dnsmessage.TypeA)
+		if d := clock.Now().Sub(start); d != 0 {
+			t.Errorf("%s: second query waited %v; want no delay", name, d)
+		}
+	}
+}
+
+func TestNoDataContract(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			if strings.HasPrefix(host, "error.") {
+				return nil, fmt.Errorf("lookup failed")
+			}
+			if strings.HasPrefix(host, "nodata.") {
+				return nil, ErrNoData
+			}
+			return []net.IP{}, nil
+		},
+		LookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			if strings.HasPrefix(name, "error.") {
+				return nil, fmt.Errorf("lookup failed")
+			}
+			if strings.HasPrefix(name, "nodata.") {
+				return nil, ErrNoData
+			}
+			return []string{}, nil
+		},
+	}
+	r := NewMemoryResolver(f)
+	ctx := context.Background()
+
+	// NODATA is reported by the Go resolver as not found
+	_, err := r.LookupIP(ctx, "ip", "nodata.example.com.")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		t.Fatalf("expected *net.DNSError, got %v", err)
+	}
+	if !dnsErr.IsNotFound || dnsErr.IsTemporary {
+		t.Errorf("expected not found error, got %#v", dnsErr)
+	}
+	_, err = r.LookupTXT(ctx, "nodata.example.com.")
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("expected not found error, got %v", err)
+	}
+
+	// an error is SERVFAIL, that the Go resolver reports as a temporary error
+	_, err = r.LookupIP(ctx, "ip", "error.example.com.")
+	if !errors.As(err, &dnsErr) {
+		t.Fatalf("expected *net.DNSError, got %v", err)
+	}
+	if dnsErr.IsNotFound || !dnsErr.IsTemporary {
+		t.Errorf("expected temporary error, got %#v", dnsErr)
+	}
+	_, err = r.LookupTXT(ctx, "error.example.com.")
+	if !errors.As(err, &dnsErr) || dnsErr.IsNotFound || !dnsErr.IsTemporary {
+		t.Errorf("expected temporary error, got %v", err)
+	}
+
+	// ErrNoData is a NOERROR response without records, and no records is
+	// NXDOMAIN
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeTXT} {
+		msg := exchange(t, f, "nodata.example.com.", qtype)
+		if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 0 {
+			t.Errorf("%v: expected NODATA, got %v with %d answers", qtype, msg.RCode, len(msg.Answers))
+		}
+		msg = exchange(t, f, "empty.example.com.", qtype)
+		if msg.RCode != dnsmessage.RCodeNameError || len(msg.Answers) != 0 {
+			t.Errorf("%v: expected NXDOMAIN, got %v with %d answers", qtype, msg.RCode, len(msg.Answers))
+		}
+	}
+}
+
+func TestServfailOnce(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.1"),
+	}
+	f.ServfailOnce("Flaky.example.com")
+	var servfailTests = []struct {
+		name  string
+		rcode dnsmessage.RCode
+	}{
+		{"other.example.com.", dnsmessage.RCodeSuccess},
+		{"flaky.example.com.", dnsmessage.RCodeServerFailure},
+		{"flaky.example.com.", dnsmessage.RCodeSuccess},
+		{"FLAKY.example.com.", dnsmessage.RCodeSuccess},
+	}
+	for i, tt := range servfailTests {
+		msg := exchange(t, f, tt.name, dnsmessage.TypeA)
+		if msg.RCode != tt.rcode {
+			t.Errorf("query %d: got %v; want %v", i, msg.RCode, tt.rcode)
+		}
+	}
+	// the failure can be armed again, the Go resolver retries the query
+	// after the SERVFAIL and gets the answer
+	f.ServfailOnce("flaky.example.com.")
+	ips, err := NewMemoryResolver(f).LookupIP(context.Background(), "ip4", "flaky.example.com.")
+	if err != nil || len(ips) != 1 {
+		t.Errorf("got %v %v; want one address", ips, err)
+	}
+	if msg := exchange(t, f, "flaky.example.com.", dnsmessage.TypeA); msg.RCode != dnsmessage.RCodeSuccess {
+		t.Errorf("got %v; want %v", msg.RCode, dnsmessage.RCodeSuccess)
+	}
+}
+
+func TestChaosTXT(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			return []string{"internet"}, nil
+		},
+		ChaosTXT: map[string][]string{
+			"version.bind":   {"mem-resolver 1.0"},
+			"hostname.bind.": {"ns1"},
+		},
+	}
+	chaosQuery := func(name string, qtype dnsmessage.Type) dnsmessage.Message {
+		query := newQuery(name, qtype)
+		query.Questions[0].Class = dnsmessage.ClassCHAOS
+		msg, _ := exchangeMsg(t, f, query, true)
+		return msg
+	}
+
+	msg := chaosQuery("version.bind.", dnsmessage.TypeTXT)
+	if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+		t.Fatalf("got %v with %d answers; want one answer", msg.RCode, len(msg.Answers))
+	}
+	if msg.Answers[0].Header.Class != dnsmessage.ClassCHAOS {
+		t.Errorf("got class %v; want %v", msg.Answers[0].Header.Class, dnsmessage.ClassCHAOS)
+	}
+	txt, ok := msg.Answers[0].Body.(*dnsmessage.TXTResource)
+	if !ok || len(txt.TXT) != 1 || txt.TXT[0] != "mem-resolver 1.0" {
+		t.Errorf("got %v; want mem-resolver 1.0", msg.Answers[0].Body)
+	}
+
+	// other types of a configured name have an empty answer
+	msg = chaosQuery("hostname.bind.", dnsmessage.TypeA)
+	if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 0 {
+		t.Errorf("got %v with %d answers; want NODATA", msg.RCode, len(msg.Answers))
+	}
+	// names not configured are refused
+	msg = chaosQuery("id.server.", dnsmessage.TypeTXT)
+	if msg.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("got %v; want %v", msg.RCode, dnsmessage.RCodeRefused)
+	}
+	// the IN class queries use the Lookup functions
+	msg = exchange(t, f, "version.bind.", dnsmessage.TypeTXT)
+	txt, ok = msg.Answers[0].Body.(*dnsmessage.TXTResource)
+	if !ok || txt.TXT[0] != "internet" {
+		t.Errorf("got %v; want internet", msg.Answers[0].Body)
+	}
+}
+
+func TestLookupSections(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupSections: func(ctx context.Context, q dnsmessage.Question) (answer, authority, additional []dnsmessage.Resource, rcode dnsmessage.RCode) {
+			ns := dnsmessage.MustNewName("ns1.example.com.")
+			answer = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: q.Class, TTL: ttl},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			}}
+			authority = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeNS, Class: q.Class, TTL: ttl},
+				Body:   &dnsmessage.NSResource{NS: ns},
+			}}
+			additional = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: ns, Type: dnsmessage.TypeA, Class: q.Class, TTL: ttl},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 53}},
+			}, {
+				Header: dnsmessage.ResourceHeader{Name: ns, Type: dnsmessage.TypeAAAA, Class: q.Class, TTL: ttl},
+				Body:   &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 0x53}},
+			}}
+			return answer, authority, additional, dnsmessage.RCodeSuccess
+		},
+	}
+	msg := exchange(t, f, "www.example.com.", dnsmessage.TypeA)
+	if len(msg.Questions) != 1 {
+		t.Errorf("got %d questions; want 1", len(msg.Questions))
+	}
+	if len(msg.Answers) != 1 || msg.Answers[0].Header.Type != dnsmessage.TypeA {
+		t.Errorf("got answers %v; want one A record", msg.Answers)
+	}
+	if len(msg.Authorities) != 1 || msg.Authorities[0].Header.Type != dnsmessage.TypeNS {
+		t.Errorf("got authorities %v; want one NS record", msg.Authorities)
+	}
+	if len(msg.Additionals) != 2 || msg.Additionals[0].Header.Type != dnsmessage.TypeA || msg.Additionals[1].Header.Type != dnsmessage.TypeAAAA {
+		t.Errorf("got additionals %v; want A and AAAA records", msg.Additionals)
+	}
+
+	// the RCODE is set in the response
+	f = &MemResolver{
+		LookupSections: func(ctx context.Context, q dnsmessage.Question) (answer, authority, additional []dnsmessage.Resource, rcode dnsmessage.RCode) {
+			return nil, nil, nil, dnsmessage.RCodeNameError
+		},
+	}
+	msg = exchange(t, f, "www.example.com.", dnsmessage.TypeA)
+	if msg.RCode != dnsmessage.RCodeNameError || len(msg.Answers) != 0 {
+		t.Errorf("got %v with %d answers; want NXDOMAIN", msg.RCode, len(msg.Answers))
+	}
+}
+
+func TestCallbackTimeout(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	defer close(release)
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			if strings.HasPrefix(host, "hung.") {
+				<-release
+			}
+			return []net.IP{net.ParseIP("192.0.2.1")}, nil
+		},
+		CallbackTimeout: 50 * time.Millisecond,
+	}
+	start := time.Now()
+	msg := exchange(t, f, "hung.example.com.", dnsmessage.TypeA)
+	if msg.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("got %v; want %v", msg.RCode, dnsmessage.RCodeServerFailure)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("SERVFAIL took %v; want around %v", elapsed, f.CallbackTimeout)
+	}
+	msg = exchange(t, f, "fast.example.com.", dnsmessage.TypeA)
+	if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+		t.Errorf("got %v with %d answers; want one answer", msg.RCode, len(msg.Answers))
+	}
+}
+
+func TestRotateIPs(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{now: time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)}
+	f := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.100"),
+		Now:      clock.Now,
+	}
+	f.RotateIPs("failover.example.com", 10*time.Second,
+		[]net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+		[]net.IP{net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::2")},
+	)
+	var rotateTests = []struct {
+		advance time.Duration
+		a       string
+		aaaa    string
+	}{
+		{0, "192.0.2.1", "2001:db8::1"},
+		{9 * time.Second, "192.0.2.1", "2001:db8::1"},
+		{1 * time.Second, "192.0.2.2", "2001:db8::2"},
+		{10 * time.Second, "192.0.2.1", "2001:db8::1"},
+		{15 * time.Second, "192.0.2.2", "2001:db8::2"},
+	}
+	for i, tt := range rotateTests {
+		clock.Advance(tt.advance)
+		msg := exchange(t, f, "failover.example.com.", dnsmessage.TypeA)
+		if len(msg.Answers) != 1 || !net.IP(msg.Answers[0].Body.(*dnsmessage.AResource).A[:]).Equal(net.ParseIP(tt.a)) {
+			t.Errorf("query %d: got %v; want %s", i, msg.Answers, tt.a)
+		}
+		msg = exchange(t, f, "failover.example.com.", dnsmessage.TypeAAAA)
+		if len(msg.Answers) != 1 || !net.IP(msg.Answers[0].Body.(*dnsmessage.AAAAResource).AAAA[:]).Equal(net.ParseIP(tt.aaaa)) {
+			t.Errorf("query %d: got %v; want %s", i, msg.Answers, tt.aaaa)
+		}
+	}
+	// a clock going backwards answers the first set
+	clock.Advance(-time.Hour)
+	msg := exchange(t, f, "failover.example.com.", dnsmessage.TypeA)
+	if len(msg.Answers) != 1 || !net.IP(msg.Answers[0].Body.(*dnsmessage.AResource).A[:]).Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("got %v; want 192.0.2.1", msg.Answers)
+	}
+	// other names use the Lookup functions
+	msg = exchange(t, f, "other.example.com.", dnsmessage.TypeA)
+	if len(msg.Answers) != 1 || !net.IP(msg.Answers[0].Body.(*dnsmessage.AResource).A[:]).Equal(net.ParseIP("192.0.2.100")) {
+		t.Errorf("got %v; want 192.0.2.100", msg.Answers)
+	}
+}
+
+func TestDropRate(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.1"),
+		DropRate: 0.3,
+	}
+	f.WithRandSource(rand.NewSource(1))
+	query := newQuery("lossy.example.com.", dnsmessage.TypeA)
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped := 0
+	for i := 0; i < 1000; i++ {
+		if f.dnsPacketRoundTrip(b) == nil {
+			dropped++
+		}
+	}
+	if dropped < 250 || dropped > 350 {
+		t.Errorf("dropped %d of 1000 queries; want around 300", dropped)
+	}
+	// TCP queries are never dropped
+	stream := append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)
+	for i := 0; i < 100; i++ {
+		if f.dnsStreamRoundTrip(stream) == nil {
+			t.Fatalf("TCP query %d dropped", i)
+		}
+	}
+}
+
+func TestRejectReservedIPs(t *testing.T) {
+	t.Parallel()
+	var reservedTests = []struct {
+		ip       string
+		qtype    dnsmessage.Type
+		reserved bool
+	}{
+		{"192.0.2.1", dnsmessage.TypeA, false},
+		{"0.1.2.3", dnsmessage.TypeA, true},
+		{"224.0.0.251", dnsmessage.TypeA, true},
+		{"240.0.0.1", dnsmessage.TypeA, true},
+		{"255.255.255.255", dnsmessage.TypeA, true},
+		{"2001:db8::1", dnsmessage.TypeAAAA, false},
+		{"::", dnsmessage.TypeAAAA, true},
+		{"ff02::fb", dnsmessage.TypeAAAA, true},
+	}
+	for _, tt := range reservedTests {
+		ip := net.ParseIP(tt.ip)
+		f := &MemResolver{
+			LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+				return []net.IP{ip}, nil
+			},
+		}
+		// the addresses are not validated by default
+		msg := exchange(t, f, "reserved.example.com.", tt.qtype)
+		if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+			t.Errorf("%s: got %v with %d answers; want one answer", tt.ip, msg.RCode, len(msg.Answers))
+		}
+		f.RejectReservedIPs = true
+		msg = exchange(t, f, "reserved.example.com.", tt.qtype)
+		if tt.reserved && msg.RCode != dnsmessage.RCodeServerFailure {
+			t.Errorf("%s: got %v; want %v", tt.ip, msg.RCode, dnsmessage.RCodeServerFailure)
+		}
+		if !tt.reserved && (msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1) {
+			t.Errorf("%s: got %v with %d answers; want one answer", tt.ip, msg.RCode, len(msg.Answers))
+		}
+	}
+}
+
+func TestGenericLookup(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		Lookup: func(ctx context.Context, q dnsmessage.Question) ([]dnsmessage.Resource, dnsmessage.RCode, error) {
+			hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: ttl}
+			switch q.Type {
+			case dnsmessage.TypeA:
+				return []dnsmessage.Resource{{
+					Header: hdr,
+					Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+				}}, dnsmessage.RCodeSuccess, nil
+			case dnsmessage.TypeMX:
+				return []dnsmessage.Resource{{
+					Header: hdr,
+					Body:   &dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("mail.example.com.")},
+				}}, dnsmessage.RCodeSuccess, nil
+			case dnsmessage.TypeNS:
+				return nil, dnsmessage.RCodeNameError, nil
+			case dnsmessage.TypeSRV:
+				return nil, dnsmessage.RCodeSuccess, fmt.Errorf("lookup failed")
+			}
+			return nil, dnsmessage.RCodeSuccess, ErrNotHandled
+		},
+		LookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			return []string{"typed"}, nil
+		},
+	}
+	r := NewMemoryResolver(f)
+	ips, err := r.LookupIP(context.Background(), "ip4", "generic.example.com.")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("got %v %v; want 192.0.2.1", ips, err)
+	}
+	mxs, err := r.LookupMX(context.Background(), "generic.example.com.")
+	if err != nil || len(mxs) != 1 || mxs[0].Host != "mail.example.com." || mxs[0].Pref != 10 {
+		t.Errorf("got %v %v; want 10 mail.example.com.", mxs, err)
+	}
+	// the typed Lookup functions answer the questions not handled
+	txt, err := r.LookupTXT(context.Background(), "generic.example.com.")
+	if err != nil || len(txt) != 1 || txt[0] != "typed" {
+		t.Errorf("got %v %v; want typed", txt, err)
+	}
+	if msg := exchange(t, f, "generic.example.com.", dnsmessage.TypeNS); msg.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("got %v; want %v", msg.RCode, dnsmessage.RCodeNameError)
+	}
+	if msg := exchange(t, f, "generic.example.com.", dnsmessage.TypeSRV); msg.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("got %v; want %v", msg.RCode, dnsmessage.RCodeServerFailure)
+	}
+}
+
+func TestLameDelegation(t *testing.T) {
+	t.Parallel()
+	// the parent delegates sub.example.com to the child nameserver
+	parent := &MemResolver{
+		LookupNS: func(ctx context.Context, name string) ([]*net.NS, error) {
+			if name == "sub.example.com." {
+				return []*net.NS{{Host: "ns.sub.example.com."}}, nil
+			}
+			return nil, fmt.Errorf("not delegated")
+		},
+	}
+	// the child serves other names but not the delegated zone
+	child := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.1"),
+	}
+	child.LameDelegation("Sub.Example.com")
+
+	ns, err := NewMemoryResolver(parent).LookupNS(context.Background(), "sub.example.com.")
+	if err != nil || len(ns) != 1 || ns[0].Host != "ns.sub.example.com." {
+		t.Fatalf("got %v %v; want ns.sub.example.com.", ns, err)
+	}
+	for _, name := range []string{"sub.example.com.", "www.sub.example.com.", "a.b.SUB.example.com."} {
+		if msg := exchange(t, child, name, dnsmessage.TypeA); msg.RCode != dnsmessage.RCodeRefused {
+			t.Errorf("%s: got %v; want %v", name, msg.RCode, dnsmessage.RCodeRefused)
+		}
+	}
+	if _, err := NewMemoryResolver(child).LookupIP(context.Background(), "ip4", "www.sub.example.com."); err == nil {
+		t.Errorf("expected error for the lame delegated zone")
+	}
+	// names outside of the zone are answered
+	for _, name := range []string{"example.com.", "othersub.example.com."} {
+		if msg := exchange(t, child, name, dnsmessage.TypeA); msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+			t.Errorf("%s: got %v with %d answers; want one answer", name, msg.RCode, len(msg.Answers))
+		}
+	}
+}
+
+func TestValidateNames(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			return []string{"ok"}, nil
+		},
+		ValidateNames: true,
+	}
+	var validateTests = []struct {
+		name  string
+		rcode dnsmessage.RCode
+	}{
+		{"www.example.com.", dnsmessage.RCodeSuccess},
+		{"_sip._tcp.example.com.", dnsmessage.RCodeSuccess},
+		{"bad\x01name.example.com.", dnsmessage.RCodeFormatError},
+		{"nul\x00.example.com.", dnsmessage.RCodeFormatError},
+		{"del\x7f.example.com.", dnsmessage.RCodeFormatError},
+		{"tab\t.example.com.", dnsmessage.RCodeFormatError},
+	}
+	for _, tt := range validateTests {
+		msg := exchange(t, f, tt.name, dnsmessage.TypeTXT)
+		if msg.RCode != tt.rcode {
+			t.Errorf("%q: got %v; want %v", tt.name, msg.RCode, tt.rcode)
+		}
+	}
+	// the names are not validated by default
+	f.ValidateNames = false
+	if msg := exchange(t, f, "bad\x01name.example.com.", dnsmessage.TypeTXT); msg.RCode != dnsmessage.RCodeSuccess {
+		t.Errorf("got %v; want %v", msg.RCode, dnsmessage.RCodeSuccess)
+	}
+}
+
+func TestTXTBeacon(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{now: time.Date(2021, 10, 1, 12, 30, 0, 0, time.UTC)}
+	f := &MemResolver{
+		Now:       clock.Now,
+		TXTBeacon: true,
+	}
+	var beaconTests = []string{"unexpected.example.com.", "Another.Example.org."}
+	for _, name := range beaconTests {
+		msg := exchange(t, f, name, dnsmessage.TypeTXT)
+		if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+			t.Fatalf("%s: got %v with %d answers; want one answer", name, msg.RCode, len(msg.Answers))
+		}
+		txt := msg.Answers[0].Body.(*dnsmessage.TXTResource).TXT
+		want := []string{name, "2021-10-01T12:30:00Z"}
+		if !reflect.DeepEqual(txt, want) {
+			t.Errorf("%s: got %q; want %q", name, txt, want)
+		}
+	}
+
+	// the configured records are answered, the beacon is used for the
+	// names not found
+	f.LookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		if name == "configured.example.com." {
+			return []string{"configured"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	msg := exchange(t, f, "configured.example.com.", dnsmessage.TypeTXT)
+	if txt := msg.Answers[0].Body.(*dnsmessage.TXTResource).TXT; len(txt) != 1 || txt[0] != "configured" {
+		t.Errorf("got %q; want configured", txt)
+	}
+	msg = exchange(t, f, "missing.example.com.", dnsmessage.TypeTXT)
+	if txt := msg.Answers[0].Body.(*dnsmessage.TXTResource).TXT; len(txt) != 2 || txt[0] != "missing.example.com." {
+		t.Errorf("got %q; want beacon", txt)
+	}
+}
+
+func TestFailureDelay(t *testing.T) {
+	t.Parallel()
+	start := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			if strings.HasPrefix(host, "fail.") {
+				return nil, fmt.Errorf("lookup failed")
+			}
+			return []net.IP{net.ParseIP("192.0.2.1")}, nil
+		},
+		FailureDelay: 100 * time.Millisecond,
+		Now:          clock.Now,
+		After:        clock.After,
+	}
+	msg := exchange(t, f, "fail.example.com.", dnsmessage.TypeA)
+	if msg.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("got %v; want %v", msg.RCode, dnsmessage.RCodeServerFailure)
+	}
+	if elapsed := clock.Now().Sub(start); elapsed != f.FailureDelay {
+		t.Errorf("SERVFAIL waited %v; want %v", elapsed, f.FailureDelay)
+	}
+	// the successful queries are not delayed
+	start = clock.Now()
+	msg = exchange(t, f, "ok.example.com.", dnsmessage.TypeA)
+	if msg.RCode != dnsmessage.RCodeSuccess {
+		t.Errorf("got %v; want %v", msg.RCode, dnsmessage.RCodeSuccess)
+	}
+	if elapsed := clock.Now().Sub(start); elapsed != 0 {
+		t.Errorf("answer waited %v; want no delay", elapsed)
+	}
+	// the delay ends with the context, the clock never fires
+	f.After = func(d time.Duration) <-chan time.Time { return nil }
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q := newQuery("fail.example.com.", dnsmessage.TypeA).Questions[0]
+	f.processDNSRequestContext(ctx, 1, q)
+}
+
+func TestIncludeGlue(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupSRV: func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+			return name, []*net.SRV{
+				{Target: "sip1.example.com.", Port: 5060, Priority: 10, Weight: 50},
+				{Target: "sip1.example.com.", Port: 5061, Priority: 10, Weight: 50},
+				{Target: "sip2.example.com.", Port: 5060, Priority: 20, Weight: 100},
+				{Target: "unknown.example.com.", Port: 5060, Priority: 30, Weight: 100},
+			}, nil
+		},
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			switch host {
+			case "sip1.example.com.":
+				return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, nil
+			case "sip2.example.com.":
+				return []net.IP{net.ParseIP("192.0.2.2")}, nil
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		},
+	}
+	// without IncludeGlue there are no additional records
+	msg := exchange(t, f, "_sip._udp.example.com.", dnsmessage.TypeSRV)
+	if len(msg.Answers) != 4 || len(msg.Additionals) != 0 {
+		t.Fatalf("got %d answers and %d additionals; want 4 and 0", len(msg.Answers), len(msg.Additionals))
+	}
+
+	f.IncludeGlue = true
+	msg = exchange(t, f, "_sip._udp.example.com.", dnsmessage.TypeSRV)
+	if len(msg.Answers) != 4 {
+		t.Fatalf("got %d answers; want 4", len(msg.Answers))
+	}
+	var glue []string
+	for _, rr := range msg.Additionals {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			glue = append(glue, rr.Header.Name.String()+" "+net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			glue = append(glue, rr.Header.Name.String()+" "+net.IP(body.AAAA[:]).String())
+		}
+	}
+	want := []string{
+		"sip1.example.com. 192.0.2.1",
+		"sip1.example.com. 2001:db8::1",
+		"sip2.example.com. 192.0.2.2",
+	}
+	if !reflect.DeepEqual(glue, want) {
+		t.Errorf("got glue %v; want %v", glue, want)
+	}
+
+	// the glue is filtered as the address answers
+	f.LookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		if host == "sip2.example.com." {
+			return []net.IP{net.ParseIP("0.0.0.0")}, nil
+		}
+		return append(manyIPs(3), manyIPs(3)...), nil
+	}
+	f.MaxRecordsPerRRset = 2
+	msg = exchange(t, f, "_sip._udp.example.com.", dnsmessage.TypeSRV)
+	// the answer is capped too, sip2 is not a target anymore
+	if len(msg.Answers) != 2 || len(msg.Additionals) != 2 {
+		t.Errorf("got %d answers and %d additionals; want 2 and 2", len(msg.Answers), len(msg.Additionals))
+	}
+	f.MaxRecordsPerRRset = 0
+	msg = exchange(t, f, "_sip._udp.example.com.", dnsmessage.TypeSRV)
+	// the duplicate addresses are dropped
+	if n := len(msg.Additionals); n != 3+1+3 {
+		t.Errorf("got %d additionals; want 7", n)
+	}
+	f.RejectReservedIPs = true
+	if msg := exchange(t, f, "_sip._udp.example.com.", dnsmessage.TypeSRV); msg.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("got %v; want SERVFAIL for a reserved glue address", msg.RCode)
+	}
+}
+
+func TestShuffleAnswers(t *testing.T) {
+	t.Parallel()
+	ips := manyIPs(8)
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			return ips, nil
+		},
+		LookupMX: func(ctx context.Context, name string) ([]*net.MX, error) {
+			return []*net.MX{{Host: "mx1.example.com.", Pref: 10}, {Host: "mx2.example.com.", Pref: 20}, {Host: "mx3.example.com.", Pref: 30}}, nil
+		},
+	}
+	answerOrder := func(qtype dnsmessage.Type) string {
+		msg := exchange(t, f, "shuffle.example.com.", qtype)
+		var order []string
+		for _, rr := range msg.Answers {
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				order = append(order, net.IP(body.A[:]).String())
+			case *dnsmessage.MXResource:
+				order = append(order, body.MX.String())
+			}
+		}
+		return strings.Join(order, ",")
+	}
+	// the order is deterministic by default
+	want := answerOrder(dnsmessage.TypeA)
+	if got := answerOrder(dnsmessage.TypeA); got != want {
+		t.Fatalf("got %s; want %s", got, want)
+	}
+
+	f.ShuffleAnswers = true
+	f.WithRandSource(rand.NewSource(1))
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeMX} {
+		orders := map[string]bool{}
+		var set string
+		for i := 0; i < 20; i++ {
+			order := answerOrder(qtype)
+			orders[order] = true
+			sorted := strings.Split(order, ",")
+			sort.Strings(sorted)
+			if i == 0 {
+				set = strings.Join(sorted, ",")
+			} else if s := strings.Join(sorted, ","); s != set {
+				t.Fatalf("%v: got records %s; want %s", qtype, s, set)
+			}
+		}
+		if len(orders) < 2 {
+			t.Errorf("%v: got the same order in all the queries", qtype)
+		}
+	}
+	// the records of the Lookup function are not modified
+	for i, ip := range ips {
+		if !ip.Equal(manyIPs(8)[i]) {
+			t.Fatalf("LookupIP result modified: %v", ips)
+		}
+	}
+}
+
+func TestRejectZeroID(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.1"),
+	}
+	query := newQuery("zero.example.com.", dnsmessage.TypeA)
+	query.ID = 0
+	for _, udp := range []bool{true, false} {
+		// the ID 0 is echoed by default
+		f.RejectZeroID = false
+		msg, _ := exchangeMsg(t, f, query, udp)
+		if msg.ID != 0 || msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+			t.Errorf("udp %v: got ID %d %v with %d answers; want ID 0 with one answer", udp, msg.ID, msg.RCode, len(msg.Answers))
+		}
+		f.RejectZeroID = true
+		msg, _ = exchangeMsg(t, f, query, udp)
+		if msg.ID != 0 || msg.RCode != dnsmessage.RCodeFormatError {
+			t.Errorf("udp %v: got ID %d %v; want ID 0 %v", udp, msg.ID, msg.RCode, dnsmessage.RCodeFormatError)
+		}
+		// other IDs are answered
+		msg = exchange(t, f, "zero.example.com.", dnsmessage.TypeA)
+		if msg.RCode != dnsmessage.RCodeSuccess {
+			t.Errorf("udp %v: got %v; want %v", udp, msg.RCode, dnsmessage.RCodeSuccess)
+		}
+	}
+}
+
+func TestNameKeys(t *testing.T) {
+	t.Parallel()
+	ip := net.ParseIP("192.0.2.1")
+	for _, key := range []string{"keys.example.com", "keys.example.com.", "KEYS.Example.COM"} {
+		f := &MemResolver{
+			WeightedA:    map[string][]WeightedIP{key: {{IP: ip, Weight: 1}}},
+			OmitQuestion: map[string]bool{key: true},
+			ChaosTXT:     map[string][]string{key: {"chaos"}},
+		}
+		for _, name := range []string{"keys.example.com.", "Keys.Example.Com."} {
+			msg := exchange(t, f, name, dnsmessage.TypeA)
+			if len(msg.Answers) != 1 || len(msg.Questions) != 0 {
+				t.Errorf("key %q name %s: got %d answers and %d questions; want WeightedA and OmitQuestion to match", key, name, len(msg.Answers), len(msg.Questions))
+			}
+			query := newQuery(name, dnsmessage.TypeTXT)
+			query.Questions[0].Class = dnsmessage.ClassCHAOS
+			msg, _ = exchangeMsg(t, f, query, true)
+			if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+				t.Errorf("key %q name %s: got %v; want ChaosTXT to match", key, name, msg.RCode)
+			}
+		}
+		f.ServfailOnce(key)
+		if msg := exchange(t, f, "keys.example.com.", dnsmessage.TypeA); msg.RCode != dnsmessage.RCodeServerFailure {
+			t.Errorf("key %q: got %v; want ServfailOnce to match", key, msg.RCode)
+		}
+		f.RotateIPs(key, time.Hour, []net.IP{net.ParseIP("192.0.2.2")})
+		f.WeightedA = nil
+		msg := exchange(t, f, "keys.example.com.", dnsmessage.TypeA)
+		if len(msg.Answers) != 1 || !net.IP(msg.Answers[0].Body.(*dnsmessage.AResource).A[:]).Equal(net.ParseIP("192.0.2.2")) {
+			t.Errorf("key %q: got %v; want RotateIPs to match", key, msg.Answers)
+		}
+		f.LameDelegation(key)
+		if msg := exchange(t, f, "keys.example.com.", dnsmessage.TypeA); msg.RCode != dnsmessage.RCodeRefused {
+			t.Errorf("key %q: got %v; want LameDelegation to match", key, msg.RCode)
+		}
+
+		records, err := NewFromMap(map[string]map[dnsmessage.Type][]string{key: {dnsmessage.TypeA: {"192.0.2.1"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg := exchange(t, records, "keys.example.com.", dnsmessage.TypeA); len(msg.Answers) != 1 {
+			t.Errorf("key %q: got %d answers; want NewFromMap to match", key, len(msg.Answers))
+		}
+	}
+}
+
+func TestFeatureGate(t *testing.T) {
+	t.Parallel()
+	f := resolverWithIP("192.0.2.100")
+	f.ControlResolver = resolverWithIP("192.0.2.1")
+	f.VariantResolver = resolverWithIP("192.0.2.2")
+	f.FeatureGate = func(q dnsmessage.Question) bool {
+		return strings.HasPrefix(strings.ToLower(q.Name.String()), "b")
+	}
+	var gateTests = []struct {
+		name string
+		want string
+	}{
+		{"a1.example.com.", "192.0.2.1"},
+		{"b1.example.com.", "192.0.2.2"},
+		{"a2.example.com.", "192.0.2.1"},
+		{"B2.example.com.", "192.0.2.2"},
+	}
+	for _, tt := range gateTests {
+		msg := exchange(t, f, tt.name, dnsmessage.TypeA)
+		if len(msg.Answers) != 1 {
+			t.Fatalf("%s: got %d answers; want 1", tt.name, len(msg.Answers))
+		}
+		if got := net.IP(msg.Answers[0].Body.(*dnsmessage.AResource).A[:]); !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("%s: got %v; want %s", tt.name, got, tt.want)
+		}
+	}
+	// without variant the resolver answers
+	f.VariantResolver = nil
+	msg := exchange(t, f, "b1.example.com.", dnsmessage.TypeA)
+	if got := net.IP(msg.Answers[0].Body.(*dnsmessage.AResource).A[:]); !got.Equal(net.ParseIP("192.0.2.100")) {
+		t.Errorf("got %v; want 192.0.2.100", got)
+	}
+}
+
+func TestStreamLengthPrefix(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.1"),
+	}
+	query := newQuery("tcp.example.com.", dnsmessage.TypeA)
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prefixTests = []struct {
+		name string
+		msg  []byte
+	}{
+		{"empty", []byte{}},
+		{"short prefix", []byte{0}},
+		{"zero length", append([]byte{0, 0}, b...)},
+		{"length bigger than the message", append([]byte{0, byte(len(b) + 1)}, b...)},
+		{"length bigger than the maximum", append([]byte{0xff, 0xff}, b...)},
+	}
+	for _, tt := range prefixTests {
+		if answer := f.dnsStreamRoundTrip(tt.msg); answer != nil {
+			t.Errorf("%s: got answer %v; want none", tt.name, answer)
+		}
+	}
+	// the bytes after the declared length are ignored
+	answer := f.dnsStreamRoundTrip(append(append([]byte{0, byte(len(b))}, b...), 0, 0, 0))
+	var msg dnsmessage.Message
+	if err := msg.Unpack(answer[2:]); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answers) != 1 {
+		t.Errorf("got %d answers; want 1", len(msg.Answers))
+	}
+
+	// the connection is closed for the client
+	conn, err := f.Dial(context.Background(), "tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(append([]byte{0, byte(len(b) + 10)}, b...)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(make([]byte, 512)); n != 0 || err == nil {
+		t.Errorf("got %d bytes and error %v; want no answer", n, err)
+	}
+}
+
+func TestMaxRecordsPerRRset(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			return manyIPs(10), nil
+		},
+		LookupNS: func(ctx context.Context, name string) ([]*net.NS, error) {
+			return []*net.NS{{Host: "ns1.example.com."}, {Host: "ns2.example.com."}}, nil
+		},
+		MaxRecordsPerRRset: 3,
+	}
+	msg := exchange(t, f, "capped.example.com.", dnsmessage.TypeA)
+	if len(msg.Answers) != 3 {
+		t.Fatalf("got %d answers; want 3", len(msg.Answers))
+	}
+	for i, rr := range msg.Answers {
+		if got := net.IP(rr.Body.(*dnsmessage.AResource).A[:]); !got.Equal(manyIPs(10)[i]) {
+			t.Errorf("answer %d: got %v; want %v", i, got, manyIPs(10)[i])
+		}
+	}
+	// smaller RRsets are not modified
+	if msg := exchange(t, f, "capped.example.com.", dnsmessage.TypeNS); len(msg.Answers) != 2 {
+		t.Errorf("got %d answers; want 2", len(msg.Answers))
+	}
+	// the cap applies after shuffling
+	f.ShuffleAnswers = true
+	f.WithRandSource(rand.NewSource(1))
+	if msg := exchange(t, f, "capped.example.com.", dnsmessage.TypeA); len(msg.Answers) != 3 {
+		t.Errorf("got %d answers; want 3", len(msg.Answers))
+	}
+
+	// the cap applies to each RRset of the Lookup and LookupSections records
+	rrs := func(q dnsmessage.Question, t dnsmessage.Type, n int) []dnsmessage.Resource {
+		var rrs []dnsmessage.Resource
+		for i := 0; i < n; i++ {
+			h := dnsmessage.ResourceHeader{Name: q.Name, Type: t, Class: q.Class, TTL: ttl}
+			if t == dnsmessage.TypeA {
+				rrs = append(rrs, dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}}})
+			} else {
+				rrs = append(rrs, dnsmessage.Resource{Header: h, Body: &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: byte(i)}}})
+			}
+		}
+		return rrs
+	}
+	lookups := map[string]*MemResolver{
+		"Lookup": {
+			Lookup: func(ctx context.Context, q dnsmessage.Question) ([]dnsmessage.Resource, dnsmessage.RCode, error) {
+				return append(rrs(q, dnsmessage.TypeA, 10), rrs(q, dnsmessage.TypeAAAA, 10)...), dnsmessage.RCodeSuccess, nil
+			},
+			MaxRecordsPerRRset: 3,
+		},
+		"LookupSections": {
+			LookupSections: func(ctx context.Context, q dnsmessage.Question) (answer, authority, additional []dnsmessage.Resource, rcode dnsmessage.RCode) {
+				return append(rrs(q, dnsmessage.TypeA, 10), rrs(q, dnsmessage.TypeAAAA, 10)...), nil, rrs(q, dnsmessage.TypeA, 10), dnsmessage.RCodeSuccess
+			},
+			MaxRecordsPerRRset: 3,
+		},
+	}
+	for name, f := range lookups {
+		msg := exchange(t, f, "capped.example.com.", dnsmessage.TypeA)
+		if len(msg.Answers) != 6 {
+			t.Errorf("%s: got %d answers; want 3 A and 3 AAAA", name, len(msg.Answers))
+		}
+		if name == "LookupSections" && len(msg.Additionals) != 3 {
+			t.Errorf("%s: got %d additionals; want 3", name, len(msg.Additionals))
+		}
+	}
+}
+
+func TestWeightedViews(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		WeightedViews: []WeightedView{
+			{Resolver: resolverWithIP("192.0.2.1"), Weight: 70},
+			{Resolver: resolverWithIP("192.0.2.2"), Weight: 20},
+			{Resolver: resolverWithIP("192.0.2.3"), Weight: 10},
+			{Resolver: resolverWithIP("192.0.2.4"), Weight: 0},
+		},
+	}
+	f.WithRandSource(rand.NewSource(1))
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		msg := exchange(t, f, "cdn.example.com.", dnsmessage.TypeA)
+		if len(msg.Answers) != 1 {
+			t.Fatalf("got %d answers; want 1", len(msg.Answers))
+		}
+		counts[net.IP(msg.Answers[0].Body.(*dnsmessage.AResource).A[:]).String()]++
+	}
+	var viewTests = []struct {
+		ip       string
+		min, max int
+	}{
+		{"192.0.2.1", 650, 750},
+		{"192.0.2.2", 160, 240},
+		{"192.0.2.3", 70, 130},
+		{"192.0.2.4", 0, 0},
+	}
+	for _, tt := range viewTests {
+		if counts[tt.ip] < tt.min || counts[tt.ip] > tt.max {
+			t.Errorf("%s: got %d of 1000 queries; want between %d and %d", tt.ip, counts[tt.ip], tt.min, tt.max)
+		}
+	}
+}
+
+func TestDedupPolicy(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.1")}, nil
+		},
+		LookupMX: func(ctx context.Context, name string) ([]*net.MX, error) {
+			return []*net.MX{{Host: "mail.example.com.", Pref: 10}, {Host: "MAIL.example.com.", Pref: 10}, {Host: "mail.example.com.", Pref: 20}}, nil
+		},
+	}
+	var dedupTests = []struct {
+		dedup DedupPolicy
+		rcode dnsmessage.RCode
+		a     int
+		mx    int
+	}{
+		{DedupDrop, dnsmessage.RCodeSuccess, 2, 2},
+		{DedupKeep, dnsmessage.RCodeSuccess, 3, 3},
+		{DedupError, dnsmessage.RCodeServerFailure, 0, 0},
+	}
+	for _, tt := range dedupTests {
+		f.DedupPolicy = tt.dedup
+		msg := exchange(t, f, "dup.example.com.", dnsmessage.TypeA)
+		if msg.RCode != tt.rcode || len(msg.Answers) != tt.a {
+			t.Errorf("policy %d A: got %v with %d answers; want %v with %d", tt.dedup, msg.RCode, len(msg.Answers), tt.rcode, tt.a)
+		}
+		msg = exchange(t, f, "dup.example.com.", dnsmessage.TypeMX)
+		if msg.RCode != tt.rcode || len(msg.Answers) != tt.mx {
+			t.Errorf("policy %d MX: got %v with %d answers; want %v with %d", tt.dedup, msg.RCode, len(msg.Answers), tt.rcode, tt.mx)
+		}
+	}
+	// the records without duplicates are answered with any policy
+	f.DedupPolicy = DedupError
+	f.LookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		return manyIPs(3), nil
+	}
+	if msg := exchange(t, f, "nodup.example.com.", dnsmessage.TypeA); msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 3 {
+		t.Errorf("got %v with %d answers; want 3 answers", msg.RCode, len(msg.Answers))
+	}
+
+	// the policy also applies to the records of Lookup and LookupSections
+	dup := func(q dnsmessage.Question) []dnsmessage.Resource {
+		var rrs []dnsmessage.Resource
+		for _, name := range []string{"dup.example.com.", "DUP.example.com.", "dup.example.com."} {
+			rrs = append(rrs, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: q.Class, TTL: ttl},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			})
+		}
+		return rrs
+	}
+	lookups := map[string]*MemResolver{
+		"Lookup": {
+			Lookup: func(ctx context.Context, q dnsmessage.Question) ([]dnsmessage.Resource, dnsmessage.RCode, error) {
+				return dup(q), dnsmessage.RCodeSuccess, nil
+			},
+		},
+		"LookupSections": {
+			LookupSections: func(ctx context.Context, q dnsmessage.Question) (answer, authority, additional []dnsmessage.Resource, rcode dnsmessage.RCode) {
+				return dup(q), nil, dup(q), dnsmessage.RCodeSuccess
+			},
+		},
+	}
+	for name, f := range lookups {
+		msg := exchange(t, f, "dup.example.com.", dnsmessage.TypeA)
+		if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+			t.Errorf("%s: got %v with %d answers; want 1 answer", name, msg.RCode, len(msg.Answers))
+		}
+		f.DedupPolicy = DedupKeep
+		if msg := exchange(t, f, "dup.example.com.", dnsmessage.TypeA); len(msg.Answers) != 3 {
+			t.Errorf("%s keep: got %d answers; want 3", name, len(msg.Answers))
+		}
+		f.DedupPolicy = DedupError
+		if msg := exchange(t, f, "dup.example.com.", dnsmessage.TypeA); msg.RCode != dnsmessage.RCodeServerFailure {
+			t.Errorf("%s error: got %v; want SERVFAIL", name, msg.RCode)
+		}
+	}
+}
+
+func TestRegexRoutes(t *testing.T) {
+	t.Parallel()
+	dbPattern := regexp.MustCompile(`^db-(\d+)\.example\.com\.$`)
+	f := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.100"),
+		RegexRoutes: []RegexRoute{
+			{
+				Pattern: dbPattern,
+				Handler: HandlerFunc(func(ctx context.Context, id uint16, q dnsmessage.Question) []byte {
+					m := dbPattern.FindStringSubmatch(strings.ToLower(q.Name.String()))
+					n, err := strconv.Atoi(m[1])
+					if err != nil || n > 255 {
+						return dnsErrorMessage(id, dnsmessage.RCodeNameError, q)
+					}
+					msg := dnsmessage.Message{
+						Header:    dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+						Questions: []dnsmessage.Question{q},
+						Answers: []dnsmessage.Resource{{
+							Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: q.Class, TTL: ttl},
+							Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, byte(n)}},
+						}},
+					}
+					buf, _ := msg.Pack()
+					return buf
+				}),
+			},
+			{
+				Pattern: regexp.MustCompile(`^db-`),
+				Handler: HandlerFunc(func(ctx context.Context, id uint16, q dnsmessage.Question) []byte {
+					return dnsErrorMessage(id, dnsmessage.RCodeRefused, q)
+				}),
+			},
+		},
+	}
+	var routeTests = []struct {
+		name  string
+		rcode dnsmessage.RCode
+		ip    string
+	}{
+		{"db-1.example.com.", dnsmessage.RCodeSuccess, "10.0.0.1"},
+		{"DB-42.Example.com.", dnsmessage.RCodeSuccess, "10.0.0.42"},
+		{"db-300.example.com.", dnsmessage.RCodeNameError, ""},
+		{"db-1.example.org.", dnsmessage.RCodeRefused, ""},
+		{"www.example.com.", dnsmessage.RCodeSuccess, "192.0.2.100"},
+	}
+	for _, tt := range routeTests {
+		msg := exchange(t, f, tt.name, dnsmessage.TypeA)
+		if msg.RCode != tt.rcode {
+			t.Errorf("%s: got %v; want %v", tt.name, msg.RCode, tt.rcode)
+			continue
+		}
+		if tt.ip == "" {
+			continue
+		}
+		if len(msg.Answers) != 1 || !net.IP(msg.Answers[0].Body.(*dnsmessage.AResource).A[:]).Equal(net.ParseIP(tt.ip)) {
+			t.Errorf("%s: got %v; want %s", tt.name, msg.Answers, tt.ip)
+		}
+	}
+}
+
+func TestMinTTL(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, nil
+		},
+		TTLByType: map[dnsmessage.Type]uint32{dnsmessage.TypeA: 5, dnsmessage.TypeAAAA: 3600},
+		MinTTL:    60,
+	}
+	var minTTLTests = []struct {
+		qtype dnsmessage.Type
+		ttl   uint32
+	}{
+		{dnsmessage.TypeA, 60},
+		{dnsmessage.TypeAAAA, 3600},
+	}
+	for _, tt := range minTTLTests {
+		msg := exchange(t, f, "floor.example.com.", tt.qtype)
+		if len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != tt.ttl {
+			t.Errorf("%v: got %v; want TTL %d", tt.qtype, msg.Answers, tt.ttl)
+		}
+	}
+
+	// the records of the generic Lookup function are raised too
+	records, err := ParseRecords("floor.example.com. 10 TXT low\nfloor.example.com. 600 MX 10 mail.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewFromRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.MinTTL = 60
+	if msg := exchange(t, g, "floor.example.com.", dnsmessage.TypeTXT); len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != 60 {
+		t.Errorf("got %v; want TTL 60", msg.Answers)
+	}
+	if msg := exchange(t, g, "floor.example.com.", dnsmessage.TypeMX); len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != 600 {
+		t.Errorf("got %v; want TTL 600", msg.Answers)
+	}
+}
+
+func TestMaxTTL(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, nil
+		},
+		TTLByType: map[dnsmessage.Type]uint32{dnsmessage.TypeA: 86400, dnsmessage.TypeAAAA: 30},
+		MaxTTL:    3600,
+	}
+	var maxTTLTests = []struct {
+		minTTL uint32
+		qtype  dnsmessage.Type
+		ttl    uint32
+	}{
+		{0, dnsmessage.TypeA, 3600},
+		{0, dnsmessage.TypeAAAA, 30},
+		{60, dnsmessage.TypeAAAA, 60},
+		// the cap has precedence over the floor
+		{7200, dnsmessage.TypeAAAA, 3600},
+	}
+	for _, tt := range maxTTLTests {
+		f.MinTTL = tt.minTTL
+		msg := exchange(t, f, "cap.example.com.", tt.qtype)
+		if len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != tt.ttl {
+			t.Errorf("min %d %v: got %v; want TTL %d", tt.minTTL, tt.qtype, msg.Answers, tt.ttl)
+		}
+	}
+
+	records, err := ParseRecords("cap.example.com. 604800 TXT long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewFromRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.MaxTTL = 3600
+	if msg := exchange(t, g, "cap.example.com.", dnsmessage.TypeTXT); len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != 3600 {
+		t.Errorf("got %v; want TTL 3600", msg.Answers)
+	}
+}
+
+func TestCrossFamilyNoData(t *testing.T) {
+	t.Parallel()
+	calls := 0
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			calls++
+			switch {
+			case host == "v4only.example.com." && network == "ip4":
+				return []net.IP{net.ParseIP("192.0.2.1")}, nil
+			case host == "v6only.example.com." && network == "ip6":
+				return []net.IP{net.ParseIP("2001:db8::1")}, nil
+			case host == "v6only.example.com.":
+				// the family not served has no addresses
+				return nil, nil
+			case host == "nodata.example.com.":
+				return nil, ErrNoData
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		},
+	}
+	var familyTests = []struct {
+		name    string
+		qtype   dnsmessage.Type
+		rcode   dnsmessage.RCode
+		answers int
+		calls   int
+	}{
+		{"v4only.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 1, 1},
+		// the ip6 lookup is not found, the ip4 lookup shows the name exists
+		{"v4only.example.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, 0, 2},
+		{"v6only.example.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, 1, 1},
+		{"v6only.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 0, 2},
+		{"nodata.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 0, 1},
+	}
+	for _, tt := range familyTests {
+		calls = 0
+		msg := exchange(t, f, tt.name, tt.qtype)
+		if msg.RCode != tt.rcode || len(msg.Answers) != tt.answers {
+			t.Errorf("%s %v: got %v with %d answers; want %v with %d", tt.name, tt.qtype, msg.RCode, len(msg.Answers), tt.rcode, tt.answers)
+		}
+		if calls != tt.calls {
+			t.Errorf("%s %v: LookupIP called %d times; want %d", tt.name, tt.qtype, calls, tt.calls)
+		}
+	}
+	if n := f.FallbackAttempts(); n != 0 {
+		t.Errorf("got %d fallback attempts; want 0", n)
+	}
+	// a name without addresses is still an error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		if msg := exchange(t, f, "missing.example.com.", qtype); msg.RCode == dnsmessage.RCodeSuccess {
+			t.Errorf("%v: got %v; want an error", qtype, msg.RCode)
+		}
+	}
+	// the Go resolver gets the addresses of the existing family
+	ips, err := NewMemoryResolver(f).LookupIP(context.Background(), "ip", "v4only.example.com.")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("got %v %v; want 192.0.2.1", ips, err)
+	}
+}
+
+func TestEmptyRRsetNoData(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			if host == "v4only.example.com." && network != "ip6" {
+				return []net.IP{net.ParseIP("192.0.2.1")}, nil
+			}
+			// no records, not an error
+			return nil, nil
+		},
+		LookupMX: func(ctx context.Context, name string) ([]*net.MX, error) {
+			return nil, nil
+		},
+		LookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			if name == "txtonly.example.com." {
+				return []string{"v=spf1 -all"}, nil
+			}
+			return nil, nil
+		},
+	}
+	var emptyTests = []struct {
+		name  string
+		qtype dnsmessage.Type
+		rcode dnsmessage.RCode
+	}{
+		{"v4only.example.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess},
+		{"v4only.example.com.", dnsmessage.TypeMX, dnsmessage.RCodeSuccess},
+		{"v4only.example.com.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess},
+		{"txtonly.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess},
+		{"txtonly.example.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess},
+		{"missing.example.com.", dnsmessage.TypeA, dnsmessage.RCodeNameError},
+		{"missing.example.com.", dnsmessage.TypeMX, dnsmessage.RCodeNameError},
+	}
+	for _, tt := range emptyTests {
+		msg := exchange(t, f, tt.name, tt.qtype)
+		if msg.RCode != tt.rcode || len(msg.Answers) != 0 {
+			t.Errorf("%s %v: got %v with %d answers; want %v with 0", tt.name, tt.qtype, msg.RCode, len(msg.Answers), tt.rcode)
+		}
+	}
+	if n := f.FallbackAttempts(); n != 0 {
+		t.Errorf("got %d fallback attempts; want 0", n)
+	}
+}
+
+func TestAppearsAfter(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.100"),
+	}
+	f.AppearsAfter("new.example.com", 3, net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1"))
+	for i := 0; i < 3; i++ {
+		if msg := exchange(t, f, "new.example.com.", dnsmessage.TypeA); msg.RCode != dnsmessage.RCodeNameError {
+			t.Errorf("query %d: got %v; want %v", i, msg.RCode, dnsmessage.RCodeNameError)
+		}
+	}
+	msg := exchange(t, f, "new.example.com.", dnsmessage.TypeA)
+	if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 || !net.IP(msg.Answers[0].Body.(*dnsmessage.AResource).A[:]).Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("got %v %v; want 192.0.2.1", msg.RCode, msg.Answers)
+	}
+	msg = exchange(t, f, "new.example.com.", dnsmessage.TypeAAAA)
+	if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+		t.Errorf("got %v %v; want 2001:db8::1", msg.RCode, msg.Answers)
+	}
+	// other names are not affected
+	if msg := exchange(t, f, "old.example.com.", dnsmessage.TypeA); msg.RCode != dnsmessage.RCodeSuccess {
+		t.Errorf("got %v; want %v", msg.RCode, dnsmessage.RCodeSuccess)
+	}
+}
+
+func TestTypeLatencyDist(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.1"),
+		LookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			return []string{"slow"}, nil
+		},
+		TypeLatencyDist: map[dnsmessage.Type]LatencyDist{
+			dnsmessage.TypeA:   {Mean: 50 * time.Millisecond, StdDev: 10 * time.Millisecond},
+			dnsmessage.TypeMX:  {Mean: 5 * time.Millisecond, StdDev: 20 * time.Millisecond},
+			dnsmessage.TypeTXT: {Mean: 10 * time.Millisecond},
+		},
+	}
+	f.WithRandSource(rand.NewSource(1))
+
+	// the sample mean and standard deviation match the distribution
+	const samples = 10000
+	var sum, sumSquares float64
+	for i := 0; i < samples; i++ {
+		latency := float64(f.typeLatency(dnsmessage.TypeA))
+		sum += latency
+		sumSquares += latency * latency
+	}
+	mean := sum / samples
+	stdDev := math.Sqrt(sumSquares/samples - mean*mean)
+	if mean < float64(49*time.Millisecond) || mean > float64(51*time.Millisecond) {
+		t.Errorf("got mean %v; want 50ms", time.Duration(mean))
+	}
+	if stdDev < float64(9*time.Millisecond) || stdDev > float64(11*time.Millisecond) {
+		t.Errorf("got standard deviation %v; want 10ms", time.Duration(stdDev))
+	}
+	// the latencies are never negative
+	for i := 0; i < 1000; i++ {
+		if latency := f.typeLatency(dnsmessage.TypeMX); latency < 0 {
+			t.Fatalf("got negative latency %v", latency)
+		}
+	}
+	if latency := f.typeLatency(dnsmessage.TypeTXT); latency != 10*time.Millisecond {
+		t.Errorf("got %v; want 10ms without deviation", latency)
+	}
+	if latency := f.typeLatency(dnsmessage.TypeAAAA); latency != 0 {
+		t.Errorf("got %v; want no latency for other types", latency)
+	}
+
+	// the queries are delayed
+	clock := &fakeClock{now: time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)}
+	f.Now = clock.Now
+	f.After = clock.After
+	start := clock.Now()
+	exchange(t, f, "slow.example.com.", dnsmessage.TypeTXT)
+	if elapsed := clock.Now().Sub(start); elapsed != 10*time.Millisecond {
+		t.Errorf("query waited %v; want 10ms", elapsed)
+	}
+}
+
+func TestLookupSOA(t *testing.T) {
+	t.Parallel()
+	want := dnsmessage.SOAResource{
+		NS:      dnsmessage.MustNewName("ns1.example.com."),
+		MBox:    dnsmessage.MustNewName("hostmaster.example.com."),
+		Serial:  2021100101,
+		Refresh: 7200,
+		Retry:   3600,
+		Expire:  1209600,
+		MinTTL:  300,
+	}
+	f := &MemResolver{
+		LookupSOA: func(ctx context.Context, name string) (*SOA, error) {
+			if name != "example.com." {
+				return nil, ErrNoData
+			}
+			return &SOA{
+				NS:      "ns1.example.com.",
+				Mbox:    "hostmaster.example.com.",
+				Serial:  2021100101,
+				Refresh: 7200,
+				Retry:   3600,
+				Expire:  1209600,
+				MinTTL:  300,
+			}, nil
+		},
+	}
+	msg := exchange(t, f, "example.com.", dnsmessage.TypeSOA)
+	if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+		t.Fatalf("got %v with %d answers; want 1 answer", msg.RCode, len(msg.Answers))
+	}
+	soa, ok := msg.Answers[0].Body.(*dnsmessage.SOAResource)
+	if !ok {
+		t.Fatalf("got %T; want *dnsmessage.SOAResource", msg.Answers[0].Body)
+	}
+	if !reflect.DeepEqual(*soa, want) {
+		t.Errorf("got %+v; want %+v", *soa, want)
+	}
+
+	// names without SOA are answered without records
+	msg = exchange(t, f, "www.example.com.", dnsmessage.TypeSOA)
+	if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 0 {
+		t.Errorf("got %v with %d answers; want NODATA", msg.RCode, len(msg.Answers))
+	}
+
+	// without LookupSOA the queries are not implemented
+	msg = exchange(t, &MemResolver{}, "example.com.", dnsmessage.TypeSOA)
+	if msg.RCode != dnsmessage.RCodeNotImplemented {
+		t.Errorf("got %v; want %v", msg.RCode, dnsmessage.RCodeNotImplemented)
+	}
+}
+
+func TestLookupErrorRCode(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			switch host {
+			case "unknown.example.com.":
+				return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			case "wrapped.example.com.":
+				return nil, fmt.Errorf("zone lookup: %w", &net.DNSError{Err: "no such host", Name: host, IsNotFound: true})
+			case "broken.example.com.":
+				return nil, fmt.Errorf("backend unavailable")
+			case "timeout.example.com.":
+				return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+			}
+			return nil, nil
+		},
+		LookupMX: func(ctx context.Context, name string) ([]*net.MX, error) {
+			return nil, nil
+		},
+	}
+	var rcodeTests = []struct {
+		name  string
+		qtype dnsmessage.Type
+		rcode dnsmessage.RCode
+	}{
+		{"unknown.example.com.", dnsmessage.TypeA, dnsmessage.RCodeNameError},
+		{"wrapped.example.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeNameError},
+		{"broken.example.com.", dnsmessage.TypeA, dnsmessage.RCodeServerFailure},
+		{"timeout.example.com.", dnsmessage.TypeA, dnsmessage.RCodeServerFailure},
+		{"empty.example.com.", dnsmessage.TypeA, dnsmessage.RCodeNameError},
+		{"empty.example.com.", dnsmessage.TypeMX, dnsmessage.RCodeNameError},
+	}
+	for _, tt := range rcodeTests {
+		msg := exchange(t, f, tt.name, tt.qtype)
+		if msg.RCode != tt.rcode || len(msg.Answers) != 0 {
+			t.Errorf("%s %v: got %v with %d answers; want %v", tt.name, tt.qtype, msg.RCode, len(msg.Answers), tt.rcode)
+		}
+	}
+}
+
+func TestTrailingData(t *testing.T) {
+	t.Parallel()
+	f := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.1"),
+	}
+	for _, query := range []dnsmessage.Message{
+		newQuery("trailing.example.com.", dnsmessage.TypeA),
+		newEDNSQuery("trailing.example.com.", dnsmessage.TypeA, 1232),
+	} {
+		b, err := query.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the well-formed query is answered
+		var msg dnsmessage.Message
+		if err := msg.Unpack(f.dnsPacketRoundTrip(b)); err != nil {
+			t.Fatal(err)
+		}
+		if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+			t.Fatalf("got %v with %d answers; want 1 answer", msg.RCode, len(msg.Answers))
+		}
+		// the query with trailing bytes is FORMERR
+		for _, trailing := range [][]byte{{0}, {0xde, 0xad, 0xbe, 0xef}} {
+			if err := msg.Unpack(f.dnsPacketRoundTrip(append(b, trailing...))); err != nil {
+				t.Fatal(err)
+			}
+			if msg.RCode != dnsmessage.RCodeFormatError || len(msg.Answers) != 0 {
+				t.Errorf("trailing %x: got %v with %d answers; want FORMERR", trailing, msg.RCode, len(msg.Answers))
+			}
+		}
+	}
+}
+
+func TestTTLFunc(t *testing.T) {
+	t.Parallel()
+	ttlFunc := func(q dnsmessage.Question) uint32 {
+		switch {
+		case strings.HasPrefix(q.Name.String(), "deploy."):
+			return 5
+		case q.Type == dnsmessage.TypeTXT:
+			return 7200
+		}
+		return 60
+	}
+	f := &MemResolver{
+		LookupIP: lookupIPs("192.0.2.1"),
+		LookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			return []string{"txt"}, nil
+		},
+		TTL:       600,
+		TTLByType: map[dnsmessage.Type]uint32{dnsmessage.TypeA: 900},
+		MinTTL:    30,
+		MaxTTL:    3600,
+		TTLFunc:   ttlFunc,
+	}
+	var ttlFuncTests = []struct {
+		name  string
+		qtype dnsmessage.Type
+		ttl   uint32
+	}{
+		{"deploy.example.com.", dnsmessage.TypeA, 5},
+		{"deploy.example.com.", dnsmessage.TypeTXT, 5},
+		{"www.example.com.", dnsmessage.TypeA, 60},
+		{"www.example.com.", dnsmessage.TypeTXT, 7200},
+	}
+	for _, tt := range ttlFuncTests {
+		msg := exchange(t, f, tt.name, tt.qtype)
+		if len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != tt.ttl {
+			t.Errorf("%s %v: got %v; want TTL %d", tt.name, tt.qtype, msg.Answers, tt.ttl)
+		}
+	}
+
+	// the TTLs of the generic Lookup records are overridden too
+	records, err := ParseRecords(`
+deploy.example.com. 300 A 192.0.2.1
+www.example.com. 300 A 192.0.2.2
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewFromRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.TTLFunc = ttlFunc
+	for _, tt := range ttlFuncTests {
+		if tt.qtype != dnsmessage.TypeA {
+			continue
+		}
+		msg := exchange(t, g, tt.name, tt.qtype)
+		if len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != tt.ttl {
+			t.Errorf("%s %v: got %v; want TTL %d", tt.name, tt.qtype, msg.Answers, tt.ttl)
+		}
+	}
+}
+
+func TestEmptyAnswerLookups(t *testing.T) {
+	t.Parallel()
+	calls := 0
+	f := &MemResolver{
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			calls++
+			if host == "empty.example.com." {
+				return nil, nil
+			}
+			// the network is ignored, like the Lookup functions returning
+			// all the addresses of the name
+			return []net.IP{net.ParseIP("192.0.2.1")}, nil
+		},
+	}
+	var emptyTests = []struct {
+		name  string
+		rcode dnsmessage.RCode
+		calls int
+	}{
+		// the addresses of the other family already show the name exists
+		{"v4only.example.com.", dnsmessage.RCodeSuccess, 1},
+		// the other family is checked, without fallback
+		{"empty.example.com.", dnsmessage.RCodeNameError, 2},
+	}
+	for _, tt := range emptyTests {
+		calls = 0
+		msg := exchange(t, f, tt.name, dnsmessage.TypeAAAA)
+		if msg.RCode != tt.rcode || len(msg.Answers) != 0 {
+			t.Errorf("%s: got %v with %d answers; want %v", tt.name, msg.RCode, len(msg.Answers), tt.rcode)
+		}
+		if calls != tt.calls {
+			t.Errorf("%s: LookupIP called %d times; want %d", tt.name, calls, tt.calls)
+		}
+	}
+	if n := f.FallbackAttempts(); n != 0 {
+		t.Errorf("got %d fallback attempts; want 0", n)
+	}
+
+	// the lookups without LookupIP try the fallback once
+	g := &MemResolver{FailOnFallback: true}
+	exchange(t, g, "empty.example.com.", dnsmessage.TypeAAAA)
+	if n := g.FallbackAttempts(); n != 1 {
+		t.Errorf("got %d fallback attempts; want 1", n)
+	}
+}
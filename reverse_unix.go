@@ -0,0 +1,117 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxReverseZoneSize is the maximum number of addresses of a ReverseZone.
+const maxReverseZoneSize = 1 << 16
+
+// ReverseZone returns a MemResolver that answers the PTR queries for every
+// address in the CIDR with the name returned by nameFunc. An empty name means
+// the address has no PTR record. The names are generated when the resolver is
+// created, so ranges bigger than a /16 for IPv4 or a /112 for IPv6 are rejected.
+func ReverseZone(cidr string, nameFunc func(ip net.IP) string) (*MemResolver, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones > 16 {
+		return nil, fmt.Errorf("range %s is bigger than %d addresses", cidr, maxReverseZoneSize)
+	}
+	names := map[string]string{}
+	for ip := ipnet.IP; ipnet.Contains(ip); ip = nextIP(ip) {
+		if name := nameFunc(ip); name != "" {
+			names[reverseName(ip)] = canonicalName(name)
+		}
+	}
+	return &MemResolver{
+		LookupAddr: func(ctx context.Context, addr string) ([]string, error) {
+			ip, ok := reverseAddr(addr)
+			if !ok || !ipnet.Contains(ip) {
+				return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+			}
+			name, ok := names[reverseName(ip)]
+			if !ok {
+				return nil, ErrNoData
+			}
+			return []string{name}, nil
+		},
+	}, nil
+}
+
+// nextIP returns the address following ip.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of the address.
+func reverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	var sb strings.Builder
+	ip6 := ip.To16()
+	for i := len(ip6) - 1; i >= 0; i-- {
+		fmt.Fprintf(&sb, "%x.%x.", ip6[i]&0xF, ip6[i]>>4)
+	}
+	sb.WriteString("ip6.arpa.")
+	return sb.String()
+}
+
+// reverseAddr returns the address of an in-addr.arpa or ip6.arpa name.
+func reverseAddr(name string) (net.IP, bool) {
+	name = canonicalName(name)
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != net.IPv4len {
+			return nil, false
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, l := range labels {
+			v, err := strconv.ParseUint(l, 10, 8)
+			if err != nil {
+				return nil, false
+			}
+			ip[net.IPv4len-1-i] = byte(v)
+		}
+		return net.IPv4(ip[0], ip[1], ip[2], ip[3]), true
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(labels) != 2*net.IPv6len {
+			return nil, false
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, l := range labels {
+			v, err := strconv.ParseUint(l, 16, 4)
+			if err != nil || len(l) != 1 {
+				return nil, false
+			}
+			b := net.IPv6len - 1 - i/2
+			if i%2 == 0 {
+				ip[b] |= byte(v)
+			} else {
+				ip[b] |= byte(v) << 4
+			}
+		}
+		return ip, true
+	}
+	return nil, false
+}
@@ -0,0 +1,86 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestReverseZone(t *testing.T) {
+	t.Parallel()
+	f, err := ReverseZone("192.0.2.16/28", func(ip net.IP) string {
+		return fmt.Sprintf("host-%d.example.com", ip.To4()[3])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewMemoryResolver(f)
+	var reverseTests = []struct {
+		addr string
+		name string
+	}{
+		{"192.0.2.16", "host-16.example.com."},
+		{"192.0.2.20", "host-20.example.com."},
+		{"192.0.2.31", "host-31.example.com."},
+	}
+	for _, tt := range reverseTests {
+		names, err := r.LookupAddr(context.Background(), tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 1 || names[0] != tt.name {
+			t.Errorf("%s: got %v; want %s", tt.addr, names, tt.name)
+		}
+	}
+	// outside of the range
+	if names, err := r.LookupAddr(context.Background(), "192.0.2.32"); err == nil {
+		t.Errorf("got %v; want error", names)
+	}
+}
+
+func TestReverseZoneIPv6(t *testing.T) {
+	t.Parallel()
+	f, err := ReverseZone("2001:db8::/124", func(ip net.IP) string {
+		return fmt.Sprintf("host-%d.example.com", ip[15])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := NewMemoryResolver(f).LookupAddr(context.Background(), "2001:db8::a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "host-10.example.com." {
+		t.Errorf("got %v; want host-10.example.com.", names)
+	}
+}
+
+func TestReverseZoneTooBig(t *testing.T) {
+	t.Parallel()
+	for _, cidr := range []string{"10.0.0.0/8", "10.0.0.0/15", "2001:db8::/64"} {
+		if _, err := ReverseZone(cidr, func(ip net.IP) string { return "" }); err == nil {
+			t.Errorf("%s: expected error", cidr)
+		}
+	}
+	if _, err := ReverseZone("10.0.0.0/16", func(ip net.IP) string { return "" }); err != nil {
+		t.Errorf("10.0.0.0/16: unexpected error %v", err)
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	t.Parallel()
+	for _, addr := range []string{"192.0.2.1", "2001:db8::1", "::1", "fe80::1:2:3:4"} {
+		ip := net.ParseIP(addr)
+		got, ok := reverseAddr(reverseName(ip))
+		if !ok || !got.Equal(ip) {
+			t.Errorf("%s: got %v from %s", addr, got, reverseName(ip))
+		}
+	}
+	if got := reverseName(net.ParseIP("192.0.2.1")); got != "1.2.0.192.in-addr.arpa." {
+		t.Errorf("got %s; want 1.2.0.192.in-addr.arpa.", got)
+	}
+}